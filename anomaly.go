@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// anomalyMon learns a baseline of requests per interval and alerts when an interval deviates from
+// it by more than a number of standard deviations. The baseline is an exponentially weighted moving
+// average and variance, or optionally an additive Holt-Winters model with a daily season.
+type anomalyMon struct {
+	alert    *satMon       // alert holds the rule's name, deviation threshold, and alert state.
+	hits     int64         // hits is the number of requests in the current interval.
+	interval time.Duration // interval is how often the rate is sampled.
+	warmup   int           // warmup is how many intervals to learn before alerting.
+	n        int           // n is how many intervals have been learned.
+	mean     float64       // mean is the expected hits per interval (or the level, if seasonal).
+	variance float64       // variance is the variance of hits per interval around the expectation.
+	seasonal bool          // seasonal is whether to model a daily cycle.
+	trend    float64       // trend is the change in level per interval (seasonal only).
+	season   []float64     // season is the daily offset from the level per interval slot (seasonal only).
+}
+
+const (
+	// anomalyAlpha is how quickly the baseline (and the level) follows traffic.
+	anomalyAlpha = 0.1
+	// anomalyBeta is how quickly the trend follows the level.
+	anomalyBeta = 0.01
+	// anomalyGamma is how quickly each slot of the daily season follows traffic.
+	anomalyGamma = 0.1
+)
+
+// newAnomalyMonitor returns a pointer to a new anomalyMon that alerts when the requests in a -f
+// interval are more than -anomaly standard deviations from the baseline.
+func newAnomalyMonitor(opts ...func(*anomalyMon)) *anomalyMon {
+	a := &anomalyMon{
+		alert: newSaturationMonitor(func(s *satMon) {
+			s.name = "Traffic anomaly"
+			s.metric = "anomaly"
+			s.threshold = anomalyLimit
+			s.recovery = 0
+		}),
+		interval: time.Second * time.Duration(reportFrequency),
+		warmup:   anomalyWarmup,
+		seasonal: anomalySeasonal,
+	}
+
+	for i := range opts {
+		opts[i](a)
+	}
+
+	if a.seasonal {
+		a.season = make([]float64, int(time.Hour*24/a.interval))
+		// the first day only initializes the season
+		if a.warmup < len(a.season) {
+			a.warmup = len(a.season)
+		}
+	}
+
+	return a
+}
+
+// observe allows anomalyMon to implement the rule interface.
+func (a *anomalyMon) observe(e logEntry) {
+	atomic.AddInt64(&a.hits, 1)
+}
+
+// seen allows anomalyMon to implement the rule interface.
+func (a *anomalyMon) seen() {}
+
+// restore allows anomalyMon to implement the rule interface.
+func (a *anomalyMon) restore(firing map[string]alertEvent) {
+	a.alert.restore(firing)
+}
+
+// monitor allows anomalyMon to implement the rule interface.
+func (a *anomalyMon) monitor(ctx context.Context) {
+	t := time.NewTicker(a.interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			if e := a.evaluate(now, float64(atomic.SwapInt64(&a.hits, 0))); e != nil {
+				outputs.alert(*e)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evaluate compares an interval's hits to the baseline, then learns from them. It returns the
+// alert transition, if any.
+func (a *anomalyMon) evaluate(now time.Time, observed float64) *alertEvent {
+	expected, stdDev := a.predict(now)
+
+	var e *alertEvent
+	if a.n >= a.warmup {
+		e = a.alert.step(now, math.Abs(observed-expected)/stdDev)
+		if e != nil {
+			e.Expected = expected
+			e.StdDev = stdDev
+			e.Observed = observed
+		}
+	}
+
+	a.learn(now, observed)
+	return e
+}
+
+// predict returns the expected hits for the interval at now and their standard deviation. The
+// standard deviation is never less than a poisson process would have, so steady traffic doesn't
+// make every small change look anomalous.
+func (a *anomalyMon) predict(now time.Time) (float64, float64) {
+	expected := a.mean
+	if a.seasonal && a.n >= len(a.season) {
+		expected = a.mean + a.trend + a.season[a.slot(now)]
+	}
+	if expected < 0 {
+		expected = 0
+	}
+	return expected, math.Max(math.Sqrt(a.variance), math.Sqrt(math.Max(expected, 1)))
+}
+
+// learn updates the baseline with an interval's hits.
+func (a *anomalyMon) learn(now time.Time, observed float64) {
+	defer func() { a.n++ }()
+
+	if !a.seasonal {
+		if a.n == 0 {
+			a.mean = observed
+			return
+		}
+		diff := observed - a.mean
+		incr := anomalyAlpha * diff
+		a.mean += incr
+		a.variance = (1 - anomalyAlpha) * (a.variance + diff*incr)
+		return
+	}
+
+	slot := a.slot(now)
+	switch {
+	case a.n < len(a.season):
+		// first day: remember each slot and average the level
+		a.season[slot] = observed
+		a.mean += (observed - a.mean) / float64(a.n+1)
+		if a.n == len(a.season)-1 {
+			for i := range a.season {
+				a.season[i] -= a.mean
+			}
+		}
+	default:
+		expected, _ := a.predict(now)
+		diff := observed - expected
+		level := anomalyAlpha*(observed-a.season[slot]) + (1-anomalyAlpha)*(a.mean+a.trend)
+		a.trend = anomalyBeta*(level-a.mean) + (1-anomalyBeta)*a.trend
+		a.mean = level
+		a.season[slot] = anomalyGamma*(observed-level) + (1-anomalyGamma)*a.season[slot]
+		a.variance = (1 - anomalyAlpha) * (a.variance + anomalyAlpha*diff*diff)
+	}
+}
+
+// slot returns the interval of the day now falls in.
+func (a *anomalyMon) slot(now time.Time) int {
+	return int(now.Unix()/int64(a.interval/time.Second)) % len(a.season)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// banList maintains a block list file of the clients security alerts (and optionally high traffic
+// alerts) flag, for a firewall, web server, or fail2ban to consume. Bans last while the alert that
+// flagged the client fires and expire -ban-ttl after it recovered, and the file is atomically
+// rewritten whenever the list changes. bver never changes firewall rules itself.
+type banList struct {
+	path   string               // path is the file the list is written to.
+	format string               // format is plain, nginx, or ipset.
+	ttl    time.Duration        // ttl is how long a ban lasts after the client was last flagged.
+	bans   map[string]time.Time // bans are when each banned address or network expires.
+	held   map[string][]string  // held are the clients each firing alert flagged, by alert, which don't expire until it recovers.
+	tex    *sync.Mutex          // tex is bans', held's, and the file's lock.
+}
+
+// banSet is the ipset the ipset format fills. IPv6 clients go in banSet+"6".
+const banSet = "bver-ban"
+
+// banFormats are the formats a ban list may be written in.
+var banFormats = map[string]bool{"plain": true, "nginx": true, "ipset": true}
+
+// newBanList returns a pointer to a new banList for a "format:file" spec, with the bans from before a
+// restart still in place (see restore).
+func newBanList(spec string) (*banList, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Expected format:file")
+	}
+	if !banFormats[parts[0]] {
+		return nil, fmt.Errorf("Unknown format %q", parts[0])
+	}
+	b := &banList{
+		path:   parts[1],
+		format: parts[0],
+		ttl:    banTTL,
+		bans:   map[string]time.Time{},
+		held:   map[string][]string{},
+		tex:    &sync.Mutex{},
+	}
+	if err := b.restore(time.Now()); err != nil {
+		return nil, err
+	}
+	return b, b.write()
+}
+
+// restore rebuilds the bans from before a restart. With -journal, they're the clients flagged by
+// journaled alerts within the ttl, expiring as they would have. Otherwise they're read back from the
+// file, each banned for a fresh ttl.
+func (b *banList) restore(now time.Time) error {
+	if journalPath != "" {
+		history, err := readJournal(journalPath)
+		if err != nil {
+			return err
+		}
+		for _, a := range history {
+			if !a.Triggered || !now.Before(a.Time.Add(b.ttl)) {
+				continue
+			}
+			for _, c := range flagged(a) {
+				if c, ok := bannable(c); ok && a.Time.Add(b.ttl).After(b.bans[c]) {
+					b.bans[c] = a.Time.Add(b.ttl)
+				}
+			}
+		}
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, c := range parseBans(b.format, data) {
+		if c, ok := bannable(c); ok {
+			b.bans[c] = now.Add(b.ttl)
+		}
+	}
+	return nil
+}
+
+// parseBans returns the addresses and networks in a ban list file written in format.
+func parseBans(format string, data []byte) []string {
+	var out []string
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		switch {
+		case format == "nginx" && len(f) == 2 && f[0] == "deny":
+			out = append(out, strings.TrimSuffix(f[1], ";"))
+		case format == "ipset" && len(f) >= 3 && f[0] == "add":
+			out = append(out, f[2])
+		case format == "plain" && len(f) == 1 && !strings.HasPrefix(f[0], "#"):
+			out = append(out, f[0])
+		}
+	}
+	return out
+}
+
+// bannable returns the address or network a flagged client is banned as, and false for hostnames,
+// loopback addresses, and trusted proxies, which are never banned.
+// example: "2001:DB8::1" -> "2001:db8::1", "203.0.113.0/24" -> "203.0.113.0/24"
+func bannable(client string) (string, bool) {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		var n *net.IPNet
+		var err error
+		if ip, n, err = net.ParseCIDR(client); err != nil {
+			return "", false
+		}
+		client = n.String()
+	} else {
+		client = ip.String()
+	}
+	if ip.IsLoopback() || trusted(ip) {
+		return "", false
+	}
+	return client, true
+}
+
+// flagged returns the clients an alert flags: a security alert's remote host, and the first -ban-top
+// of a high traffic alert's top clients.
+func flagged(a alertEvent) []string {
+	var out []string
+	if a.RemoteHost != "" {
+		out = append(out, a.RemoteHost)
+	}
+	for i := 0; i < banTop && i < len(a.Top); i++ {
+		out = append(out, a.Top[i].Client)
+	}
+	return out
+}
+
+// report allows banList to implement the sink interface. Expired bans are lifted with each report.
+func (b *banList) report(s stats) {
+	b.expire(time.Now())
+}
+
+// alert allows banList to implement the sink interface. Silences don't apply, as they only quiet
+// notifications.
+func (b *banList) alert(a alertEvent) {
+	key := a.Rule + " " + a.RemoteHost
+	if !a.Triggered {
+		b.release(a.Time, key)
+		return
+	}
+	b.ban(a.Time, key, flagged(a)...)
+}
+
+// ban bans clients flagged by the alert key until it recovers, and at least until the ttl after
+// now, extending any existing bans. The file is rewritten if a client wasn't banned already.
+func (b *banList) ban(now time.Time, key string, clients ...string) {
+	b.tex.Lock()
+	defer b.tex.Unlock()
+	changed := false
+	held := []string{}
+	for _, c := range clients {
+		c, ok := bannable(c)
+		if !ok {
+			continue
+		}
+		if _, ok := b.bans[c]; !ok {
+			changed = true
+		}
+		if now.Add(b.ttl).After(b.bans[c]) {
+			b.bans[c] = now.Add(b.ttl)
+		}
+		held = append(held, c)
+	}
+	b.held[key] = held
+	if !changed {
+		return
+	}
+	if err := b.write(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write ban list %s - %s\n", b.path, err.Error())
+	}
+}
+
+// release lets the bans of the clients the alert key flagged expire, the ttl after it recovered at
+// now.
+func (b *banList) release(now time.Time, key string) {
+	b.tex.Lock()
+	defer b.tex.Unlock()
+	for _, c := range b.held[key] {
+		if now.Add(b.ttl).After(b.bans[c]) {
+			b.bans[c] = now.Add(b.ttl)
+		}
+	}
+	delete(b.held, key)
+}
+
+// expire lifts the bans that expired by now, unless a firing alert still holds them, rewriting the
+// file if any were lifted.
+func (b *banList) expire(now time.Time) {
+	b.tex.Lock()
+	defer b.tex.Unlock()
+	held := map[string]bool{}
+	for _, clients := range b.held {
+		for _, c := range clients {
+			held[c] = true
+		}
+	}
+	changed := false
+	for c, until := range b.bans {
+		if !now.Before(until) && !held[c] {
+			delete(b.bans, c)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := b.write(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write ban list %s - %s\n", b.path, err.Error())
+	}
+}
+
+// write atomically replaces the file with the current bans. b.tex must be held.
+func (b *banList) write() error {
+	return writeFileAtomic(b.path, b.render())
+}
+
+// render returns the bans, sorted, in the list's format: one address or network per line (plain),
+// "deny" directives to include in an nginx server block (nginx), or input for "ipset restore" that
+// replaces the contents of the bver-ban and bver-ban6 sets (ipset).
+func (b *banList) render() []byte {
+	clients := make([]string, 0, len(b.bans))
+	for c := range b.bans {
+		clients = append(clients, c)
+	}
+	sort.Strings(clients)
+
+	buf := &bytes.Buffer{}
+	switch b.format {
+	case "nginx":
+		for _, c := range clients {
+			fmt.Fprintf(buf, "deny %s;\n", c)
+		}
+	case "ipset":
+		fmt.Fprintf(buf, "create %s hash:net family inet -exist\nflush %s\n", banSet, banSet)
+		fmt.Fprintf(buf, "create %s6 hash:net family inet6 -exist\nflush %s6\n", banSet, banSet)
+		for _, c := range clients {
+			set := banSet
+			if strings.Contains(c, ":") {
+				set += "6"
+			}
+			fmt.Fprintf(buf, "add %s %s -exist\n", set, c)
+		}
+	default:
+		for _, c := range clients {
+			fmt.Fprintln(buf, c)
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path, so readers
+// see either the old or the new contents, never a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// clientCount is how much traffic one client (or network, see -client-prefix) sent.
+	clientCount struct {
+		Client string `json:"client"` // Client is the remote host, or its network.
+		Hits   int64  `json:"hits"`   // Hits is how many requests the client made.
+		Bytes  int64  `json:"bytes"`  // Bytes is how many bytes were sent to the client.
+	}
+
+	// talkerTable counts the heaviest clients in bounded memory (the space-saving algorithm). Once
+	// full, a new client replaces the one with the fewest hits and inherits its counts, so counts
+	// are overestimates, but any client with more than 1/capacity of the hits is always kept. A
+	// min-heap finds the client to replace in O(log capacity).
+	talkerTable struct {
+		counts   map[string]*talkerEntry // counts are the tracked clients.
+		fewest   talkerHeap              // fewest are the tracked clients, fewest hits first.
+		capacity int                     // capacity is how many clients are tracked.
+	}
+
+	// talkerEntry is a tracked client's counts and its place in the heap.
+	talkerEntry struct {
+		clientCount
+		index int // index is the entry's position in the heap.
+	}
+
+	// talkerHeap is a min-heap of clients by hits. Of clients with equal hits, the greatest sorts
+	// first, so the same client is replaced whatever the order they were added in.
+	talkerHeap []*talkerEntry
+
+	// clientWindow tracks the heaviest clients over a sliding window of report intervals, for
+	// naming the top contributors in high traffic alerts.
+	clientWindow struct {
+		slots []*talkerTable // slots are the tables for each interval of the window, as a ring.
+		cur   int            // cur is the slot for the current interval.
+		tex   *sync.Mutex    // tex is slots' and cur's lock.
+	}
+)
+
+// talkerCapacity is how many clients a talkerTable tracks.
+const talkerCapacity = 1024
+
+// contributors are the heaviest clients over the -d window, nil unless -clients is set.
+var contributors *clientWindow
+
+// newTalkerTable returns a pointer to a new, empty talkerTable.
+func newTalkerTable() *talkerTable {
+	return &talkerTable{counts: map[string]*talkerEntry{}, capacity: talkerCapacity}
+}
+
+// add counts a request of bytes from client.
+func (tt *talkerTable) add(client string, bytes int64) {
+	if c, ok := tt.counts[client]; ok {
+		c.Hits++
+		c.Bytes += bytes
+		heap.Fix(&tt.fewest, c.index)
+		return
+	}
+	if len(tt.counts) >= tt.capacity {
+		// the new client takes over the fewest hits' entry and counts
+		c := tt.fewest[0]
+		delete(tt.counts, c.Client)
+		c.Client = client
+		c.Hits++
+		c.Bytes += bytes
+		tt.counts[client] = c
+		heap.Fix(&tt.fewest, 0)
+		return
+	}
+	c := &talkerEntry{clientCount: clientCount{Client: client, Hits: 1, Bytes: bytes}}
+	tt.counts[client] = c
+	heap.Push(&tt.fewest, c)
+}
+
+// merge adds all of o's counts to the table. The table isn't bounded (or kept as a heap) while
+// merging, since merged tables are only read.
+func (tt *talkerTable) merge(o *talkerTable) {
+	for client, oc := range o.counts {
+		c, ok := tt.counts[client]
+		if !ok {
+			c = &talkerEntry{clientCount: clientCount{Client: client}}
+			tt.counts[client] = c
+		}
+		c.Hits += oc.Hits
+		c.Bytes += oc.Bytes
+	}
+}
+
+// top returns the n heaviest clients by metric (hits or bytes).
+func (tt *talkerTable) top(n int, metric string) []clientCount {
+	out := make([]clientCount, 0, len(tt.counts))
+	for _, c := range tt.counts {
+		out = append(out, c.clientCount)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].Hits, out[j].Hits
+		if metric == "bytes" {
+			a, b = out[i].Bytes, out[j].Bytes
+		}
+		if a != b {
+			return a > b
+		}
+		return out[i].Client < out[j].Client
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Len allows talkerHeap to implement the heap.Interface interface.
+func (h talkerHeap) Len() int {
+	return len(h)
+}
+
+// Less allows talkerHeap to implement the heap.Interface interface.
+func (h talkerHeap) Less(i, j int) bool {
+	if h[i].Hits != h[j].Hits {
+		return h[i].Hits < h[j].Hits
+	}
+	return h[i].Client > h[j].Client
+}
+
+// Swap allows talkerHeap to implement the heap.Interface interface.
+func (h talkerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+// Push allows talkerHeap to implement the heap.Interface interface.
+func (h *talkerHeap) Push(x interface{}) {
+	e := x.(*talkerEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+// Pop allows talkerHeap to implement the heap.Interface interface.
+func (h *talkerHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// newClientWindow returns a pointer to a new clientWindow covering seconds, in intervals of freq
+// seconds.
+func newClientWindow(seconds, freq int) *clientWindow {
+	slots := make([]*talkerTable, (seconds+freq-1)/freq)
+	for i := range slots {
+		slots[i] = newTalkerTable()
+	}
+	return &clientWindow{slots: slots, tex: &sync.Mutex{}}
+}
+
+// add counts an entry toward its client in the current interval.
+func (cw *clientWindow) add(e logEntry) {
+	cw.tex.Lock()
+	defer cw.tex.Unlock()
+	cw.slots[cw.cur].add(clientKey(e.remoteHost), int64(e.txBytes))
+}
+
+// top returns the n heaviest clients by metric (hits or bytes) over the window.
+func (cw *clientWindow) top(n int, metric string) []clientCount {
+	cw.tex.Lock()
+	defer cw.tex.Unlock()
+	window := newTalkerTable()
+	for i := range cw.slots {
+		window.merge(cw.slots[i])
+	}
+	return window.top(n, metric)
+}
+
+// advance moves to the next interval's slot, dropping the oldest interval.
+func (cw *clientWindow) advance() {
+	cw.tex.Lock()
+	defer cw.tex.Unlock()
+	cw.cur = (cw.cur + 1) % len(cw.slots)
+	cw.slots[cw.cur] = newTalkerTable()
+}
+
+// clientHost returns the address in a remote host field in canonical form, so the same client is
+// always counted the same way. Brackets, ports, and IPv6 zones are dropped, and IPv4-mapped IPv6
+// addresses become IPv4. Hostnames are returned lowercased.
+// example: "[2001:DB8::1]:443" -> "2001:db8::1", "::ffff:10.0.0.1" -> "10.0.0.1"
+func clientHost(host string) string {
+	h := host
+	if strings.HasPrefix(h, "[") {
+		if i := strings.Index(h, "]"); i > 0 {
+			h = h[1:i]
+		}
+	} else if strings.Count(h, ":") == 1 {
+		// ipv4 or hostname with a port
+		h = h[:strings.Index(h, ":")]
+	}
+	if i := strings.Index(h, "%"); i > 0 {
+		h = h[:i]
+	}
+	if ip := net.ParseIP(h); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(h)
+}
+
+// clientKey returns the key a remote host is counted under: its address, or its /24 (IPv4) or /64
+// (IPv6) network with -client-prefix.
+func clientKey(host string) string {
+	h := clientHost(host)
+	if !clientPrefix {
+		return h
+	}
+	ip := net.ParseIP(h)
+	if ip == nil {
+		return h
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%s/24", v4.Mask(net.CIDRMask(24, 32)))
+	}
+	return fmt.Sprintf("%s/64", ip.Mask(net.CIDRMask(64, 128)))
+}
+
+// addClient counts an entry toward its client's hits and bytes for the interval.
+func (s *stats) addClient(e logEntry) {
+	s.reqTex.Lock()
+	defer s.reqTex.Unlock()
+	if s.clients == nil {
+		s.clients = newTalkerTable()
+	}
+	s.clients.add(clientKey(e.remoteHost), int64(e.txBytes))
+}
+
+// printClients prints the heaviest clients to w, by hits.
+func (s stats) printClients(w io.Writer) {
+	if len(s.topClients) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Top clients:")
+	for _, c := range s.topClients {
+		fmt.Fprintf(w, "%3d %dB %s\n", c.Hits, c.Bytes, c.Client)
+	}
+	fmt.Fprintln(w)
+}
+
+// formatClients returns clients as a list, e.g. "10.0.0.1 (520), 10.0.0.2 (310)", with their
+// hits, or bytes if metric is bytes.
+func formatClients(clients []clientCount, metric string) string {
+	parts := make([]string, len(clients))
+	for i, c := range clients {
+		n := c.Hits
+		if metric == "bytes" {
+			n = c.Bytes
+		}
+		parts[i] = fmt.Sprintf("%s (%d)", c.Client, n)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// commandSink runs a shell command for every alert transition. The transition is passed in BVER_*
+// environment variables, and as a json event on stdin.
+type commandSink struct {
+	command string        // command is the shell command to run.
+	timeout time.Duration // timeout is how long the command may run before it is killed.
+	running chan struct{} // running limits how many commands run at once.
+}
+
+// newCommandSink returns a pointer to a new commandSink.
+func newCommandSink(command string, timeout time.Duration, limit int) *commandSink {
+	return &commandSink{
+		command: command,
+		timeout: timeout,
+		running: make(chan struct{}, limit),
+	}
+}
+
+// report allows commandSink to implement the sink interface.
+func (cs *commandSink) report(s stats) {}
+
+// alert allows commandSink to implement the sink interface. It waits while too many commands are
+// running, so further transitions queue (or are dropped) like any other slow sink's.
+func (cs *commandSink) alert(a alertEvent) {
+	cs.running <- struct{}{}
+	go func() {
+		defer func() { <-cs.running }()
+		if err := cs.run(a); err != nil {
+			fmt.Fprintf(os.Stderr, "Alert command for %s failed - %s\n", a.Rule, err.Error())
+		}
+	}()
+}
+
+// run runs the command for one transition and waits for it.
+func (cs *commandSink) run(a alertEvent) error {
+	stdin := &bytes.Buffer{}
+	if err := (jsonRenderer{}).renderAlert(stdin, a); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sh", "-c", cs.command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", cs.command)
+	}
+	setProcessGroup(cmd)
+	cmd.Env = append(os.Environ(), commandEnv(a)...)
+	cmd.Stdin = stdin
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = console
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// kill the whole group, or children holding stdout open keep Wait waiting
+	var timedOut int32
+	timer := time.AfterFunc(cs.timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		killProcess(cmd)
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("Timed out after %s", cs.timeout)
+	}
+	if err != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// commandEnv returns the environment variables describing a transition.
+func commandEnv(a alertEvent) []string {
+	status := "recovered"
+	if a.Triggered {
+		status = "triggered"
+	}
+	return []string{
+		"BVER_RULE=" + a.Rule,
+		"BVER_METRIC=" + a.Metric,
+		"BVER_SECTION=" + a.Section,
+		"BVER_REMOTE_HOST=" + a.RemoteHost,
+		"BVER_STATUS=" + status,
+		"BVER_VALUE=" + a.formatValue(),
+		"BVER_OP=" + a.Op,
+		"BVER_THRESHOLD=" + strconv.FormatFloat(a.Threshold, 'f', -1, 64),
+		"BVER_TIME=" + a.Time.Format(time.RFC3339),
+	}
+}
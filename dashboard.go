@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+)
+
+// serveDashboard serves the single page dashboard. Everything it needs is embedded below so it
+// works offline (and from the scratch docker image).
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardPage))
+}
+
+// dashboardPage is the dashboard's html, css, and javascript. It loads /history, then follows
+// /events to keep the charts current.
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>bver</title>
+<style>
+  body { font-family: monospace; background: #1d1f21; color: #c5c8c6; margin: 0; padding: 1em; }
+  h1 { font-size: 1.2em; margin: 0 0 1em 0; }
+  h2 { font-size: 1em; margin: 0 0 .5em 0; color: #81a2be; }
+  .grid { display: grid; grid-template-columns: 2fr 1fr; grid-gap: 1em; }
+  .panel { background: #282a2e; padding: 1em; }
+  canvas { width: 100%; height: 200px; }
+  table { width: 100%; border-collapse: collapse; }
+  td { padding: 2px 4px; }
+  td.n { text-align: right; width: 5em; }
+  .fired { color: #cc6666; }
+  .recovered { color: #b5bd68; }
+  #status { float: right; }
+  ul { list-style: none; padding: 0; margin: 0; max-height: 220px; overflow-y: auto; }
+</style>
+</head>
+<body>
+<h1>bver <span id="status">connecting...</span></h1>
+<div class="grid">
+  <div class="panel"><h2>Requests per second</h2><canvas id="rps" width="800" height="200"></canvas></div>
+  <div class="panel"><h2>Top sections</h2><table id="sections"></table></div>
+  <div class="panel"><h2>Status classes</h2><canvas id="classes" width="800" height="200"></canvas></div>
+  <div class="panel"><h2>Alerts</h2><ul id="alerts"></ul></div>
+</div>
+<script>
+(function() {
+  var maxPoints = 360;
+  var maxAlerts = 1000;
+  var reports = [];
+  var alerts = [];
+  var colors = { "1xx": "#8abeb7", "2xx": "#b5bd68", "3xx": "#81a2be", "4xx": "#f0c674", "5xx": "#cc6666" };
+
+  function total(list) {
+    var n = 0;
+    for (var i = 0; i < list.length; i++) { n += list[i].count; }
+    return n;
+  }
+
+  function classMix(report) {
+    var mix = { "1xx": 0, "2xx": 0, "3xx": 0, "4xx": 0, "5xx": 0 };
+    var res = report.data.responses;
+    for (var i = 0; i < res.length; i++) {
+      var c = res[i].key.charAt(0) + "xx";
+      if (c in mix) { mix[c] += res[i].count; }
+    }
+    return mix;
+  }
+
+  function prep(canvas) {
+    var ctx = canvas.getContext("2d");
+    ctx.clearRect(0, 0, canvas.width, canvas.height);
+    ctx.font = "12px monospace";
+    return ctx;
+  }
+
+  function drawRps() {
+    var canvas = document.getElementById("rps");
+    var ctx = prep(canvas);
+    if (reports.length === 0) { return; }
+    var pts = [], max = 1;
+    for (var i = 0; i < reports.length; i++) {
+      var r = reports[i];
+      var v = total(r.data.requests) / (r.data.interval || 1);
+      pts.push({ t: new Date(r.time).getTime(), v: v });
+      if (v > max) { max = v; }
+    }
+    var t0 = pts[0].t, t1 = pts[pts.length - 1].t;
+    if (t1 === t0) { t1 = t0 + 1; }
+    var w = canvas.width, h = canvas.height - 15;
+    function x(t) { return (t - t0) / (t1 - t0) * (w - 40) + 35; }
+    function y(v) { return h - v / max * (h - 10); }
+
+    // alert markers
+    for (var i = 0; i < alerts.length; i++) {
+      var at = new Date(alerts[i].time).getTime();
+      if (at < t0) { continue; }
+      ctx.strokeStyle = alerts[i].data.triggered ? "#cc6666" : "#b5bd68";
+      ctx.beginPath(); ctx.moveTo(x(at), 0); ctx.lineTo(x(at), h); ctx.stroke();
+    }
+
+    ctx.fillStyle = "#969896";
+    ctx.fillText(max.toFixed(1), 0, 12);
+    ctx.fillText("0", 0, h);
+    ctx.strokeStyle = "#81a2be";
+    ctx.beginPath();
+    for (var i = 0; i < pts.length; i++) {
+      if (i === 0) { ctx.moveTo(x(pts[i].t), y(pts[i].v)); } else { ctx.lineTo(x(pts[i].t), y(pts[i].v)); }
+    }
+    ctx.stroke();
+  }
+
+  function drawClasses() {
+    var canvas = document.getElementById("classes");
+    var ctx = prep(canvas);
+    if (reports.length === 0) { return; }
+    var w = canvas.width, h = canvas.height - 15;
+    var bw = Math.max(1, (w - 35) / maxPoints);
+    for (var i = 0; i < reports.length; i++) {
+      var mix = classMix(reports[i]);
+      var sum = 0;
+      for (var k in mix) { sum += mix[k]; }
+      if (sum === 0) { continue; }
+      var top = h;
+      for (var k in mix) {
+        var bh = mix[k] / sum * h;
+        ctx.fillStyle = colors[k];
+        ctx.fillRect(35 + i * bw, top - bh, bw, bh);
+        top -= bh;
+      }
+    }
+    var lx = 35;
+    for (var k in colors) {
+      ctx.fillStyle = colors[k];
+      ctx.fillText(k, lx, canvas.height - 2);
+      lx += 40;
+    }
+  }
+
+  function drawSections() {
+    var table = document.getElementById("sections");
+    table.innerHTML = "";
+    if (reports.length === 0) { return; }
+    var reqs = reports[reports.length - 1].data.requests;
+    for (var i = 0; i < reqs.length && i < 10; i++) {
+      var row = table.insertRow();
+      var n = row.insertCell(); n.className = "n"; n.textContent = reqs[i].count;
+      row.insertCell().textContent = reqs[i].key;
+    }
+  }
+
+  function fmtValue(a) {
+    var v = a.value;
+    if (a.metric === "errorRatio") { return v.toFixed(3); }
+    if (v === Math.round(v)) { return v.toString(); }
+    // 3 significant digits, so small latencies, burn rates, and z-scores don't round to 0
+    return Math.abs(v) >= 100 ? v.toFixed(1) : parseFloat(v.toPrecision(3)).toString();
+  }
+
+  function subject(a) {
+    return a.remoteHost ? a.rule + " from " + a.remoteHost : a.rule;
+  }
+
+  function drawAlerts() {
+    var list = document.getElementById("alerts");
+    list.innerHTML = "";
+    for (var i = alerts.length - 1; i >= 0; i--) {
+      var a = alerts[i];
+      var li = document.createElement("li");
+      var when = new Date(a.time).toLocaleTimeString();
+      if (a.data.triggered) {
+        li.className = "fired";
+        li.textContent = when + " " + subject(a.data) + " - " + a.data.metric + " = " + fmtValue(a.data) + " (threshold " + a.data.op + " " + fmtValue({ metric: a.data.metric, value: a.data.threshold }) + ")" + (a.data.path ? ", last " + a.data.path : "");
+      } else {
+        li.className = "recovered";
+        li.textContent = when + " " + subject(a.data) + " recovered";
+      }
+      list.appendChild(li);
+    }
+  }
+
+  function draw() {
+    drawRps();
+    drawClasses();
+    drawSections();
+    drawAlerts();
+  }
+
+  function add(e) {
+    if (e.kind === "report") {
+      reports.push(e);
+      if (reports.length > maxPoints) { reports.shift(); }
+    } else if (e.kind === "alert") {
+      alerts.push(e);
+      if (alerts.length > maxAlerts) { alerts.shift(); }
+    }
+  }
+
+  function follow() {
+    var src = new EventSource("events?kind=report,alert");
+    src.onopen = function() { document.getElementById("status").textContent = "live"; };
+    src.onerror = function() { document.getElementById("status").textContent = "reconnecting..."; };
+    var handle = function(m) { add(JSON.parse(m.data)); draw(); };
+    src.addEventListener("report", handle);
+    src.addEventListener("alert", handle);
+  }
+
+  var xhr = new XMLHttpRequest();
+  xhr.open("GET", "history");
+  xhr.onload = function() {
+    if (xhr.status === 200) {
+      var hist = JSON.parse(xhr.responseText) || [];
+      for (var i = 0; i < hist.length; i++) { add(hist[i]); }
+      draw();
+    }
+    follow();
+  };
+  xhr.onerror = follow;
+  xhr.send();
+})();
+</script>
+</body>
+</html>
+`
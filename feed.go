@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// event defines something that happened which live clients may want to see.
+	event struct {
+		Kind string      `json:"kind"` // Kind is what type of event this is ("entry", "report", or "alert").
+		Time time.Time   `json:"time"` // Time is when the event happened.
+		Data interface{} `json:"data"` // Data is the payload of the event.
+
+		entry *logEntry // entry is the source entry of "entry" events, used for filtering.
+	}
+
+	// feed fans events out to subscribed clients.
+	feed struct {
+		subs    map[*subscriber]struct{} // subs is the set of current subscribers.
+		history []event                  // history is the most recent report and alert events.
+		tex     *sync.Mutex              // tex is subs' and history's lock.
+	}
+
+	// subscriber defines a client of a feed.
+	subscriber struct {
+		events  chan event  // events is where the feed delivers events, closed when the client is dropped.
+		filter  eventFilter // filter decides which entries the client wants.
+		dropped bool        // dropped is true once the client was disconnected.
+	}
+
+	// eventFilter defines which events a subscriber wants.
+	eventFilter struct {
+		kinds    map[string]bool // kinds is the set of wanted event kinds (all if empty).
+		sections map[string]bool // sections is the set of wanted sections (all if empty).
+		statuses []string        // statuses are the wanted status codes or classes like "5xx" (all if empty).
+		noBots   bool            // noBots is whether entries from crawlers, bots, and http libraries are unwanted.
+	}
+)
+
+const (
+	// subBuffer is how many events may queue for a client before it is considered too slow and dropped.
+	subBuffer = 64
+	// historySize is how many report and alert events are kept for clients that connect late.
+	historySize = 360
+)
+
+// events is the live event feed every part of bver publishes to.
+var events = newFeed()
+
+// newFeed returns a pointer to a new feed.
+func newFeed() *feed {
+	return &feed{
+		subs: map[*subscriber]struct{}{},
+		tex:  &sync.Mutex{},
+	}
+}
+
+// subscribe registers a new subscriber with the feed.
+func (f *feed) subscribe(filter eventFilter) *subscriber {
+	s := &subscriber{events: make(chan event, subBuffer), filter: filter}
+	f.tex.Lock()
+	f.subs[s] = struct{}{}
+	f.tex.Unlock()
+	return s
+}
+
+// unsubscribe removes a subscriber from the feed.
+func (f *feed) unsubscribe(s *subscriber) {
+	f.tex.Lock()
+	defer f.tex.Unlock()
+	f.drop(s)
+}
+
+// drop removes a subscriber and closes its channel. f.tex must be held.
+func (f *feed) drop(s *subscriber) {
+	if s.dropped {
+		return
+	}
+	s.dropped = true
+	delete(f.subs, s)
+	close(s.events)
+}
+
+// publish sends an event to every interested subscriber. Subscribers that can't keep up are
+// dropped rather than allowed to block the caller.
+func (f *feed) publish(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	f.tex.Lock()
+	defer f.tex.Unlock()
+	if e.entry == nil {
+		if len(f.history) >= historySize {
+			f.history = append(f.history[:0], f.history[1:]...)
+		}
+		f.history = append(f.history, e)
+	}
+	for s := range f.subs {
+		if !s.filter.match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			f.drop(s)
+		}
+	}
+}
+
+// publishEntry publishes a parsed log entry.
+func (f *feed) publishEntry(e logEntry) {
+	f.publish(event{Kind: "entry", Data: e, entry: &e})
+}
+
+// publishAlert publishes an alert transition.
+func (f *feed) publishAlert(a alertEvent) {
+	f.publish(event{Kind: "alert", Time: a.Time, Data: a})
+}
+
+// match returns true if the filter allows the event. Sections, statuses, and bots only filter
+// entries.
+func (ef eventFilter) match(e event) bool {
+	if len(ef.kinds) > 0 && !ef.kinds[e.Kind] {
+		return false
+	}
+	if e.entry == nil {
+		return true
+	}
+	if len(ef.sections) > 0 && !ef.sections[sectionOf(e.entry.request.path)] {
+		return false
+	}
+	if ef.noBots && e.entry.bot() {
+		return false
+	}
+	if len(ef.statuses) == 0 {
+		return true
+	}
+	code := strconv.Itoa(e.entry.respCode)
+	for i := range ef.statuses {
+		if matchStatus(ef.statuses[i], code) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchStatus returns true if code matches pattern, where an 'x' in pattern matches any digit.
+func matchStatus(pattern, code string) bool {
+	if len(pattern) != len(code) {
+		return false
+	}
+	for i := range pattern {
+		if pattern[i] != 'x' && pattern[i] != 'X' && pattern[i] != code[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFilter builds an eventFilter from "kind", "section" and "status" query parameters, which may
+// be repeated or comma separated, and "bots=false".
+func parseFilter(r *http.Request) eventFilter {
+	ef := eventFilter{kinds: map[string]bool{}, sections: map[string]bool{}}
+	q := r.URL.Query()
+	for _, v := range splitParams(q["kind"]) {
+		ef.kinds[v] = true
+	}
+	for _, v := range splitParams(q["section"]) {
+		ef.sections["/"+strings.Trim(v, "/")] = true
+	}
+	ef.statuses = splitParams(q["status"])
+	ef.noBots = q.Get("bots") == "false"
+	return ef
+}
+
+// splitParams splits comma separated query values, discarding empty ones.
+func splitParams(vals []string) []string {
+	var out []string
+	for i := range vals {
+		for _, v := range strings.Split(vals[i], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// recent returns a copy of the feed's history.
+func (f *feed) recent() []event {
+	f.tex.Lock()
+	defer f.tex.Unlock()
+	return append([]event{}, f.history...)
+}
+
+// serveHistory responds with the feed's history as a json array.
+func (f *feed) serveHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(f.recent()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveEvents streams the feed to a client as server-sent events.
+func (f *feed) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	s := f.subscribe(parseFilter(r))
+	defer f.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				// too slow, the feed dropped us
+				return
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+type (
+	// geoIP looks up the country and network of remote hosts in local MaxMind DB files. Nothing is
+	// looked up over the network.
+	geoIP struct {
+		dbs   []*mmdb            // dbs are the country (or city) and ASN databases.
+		cache map[string]geoInfo // cache is recent lookups, by address.
+		tex   *sync.Mutex        // tex is cache's lock.
+	}
+
+	// geoInfo is what the databases know about an address.
+	geoInfo struct {
+		country string // country is the ISO 3166 country code, e.g. "US".
+		asn     int    // asn is the autonomous system number.
+		asOrg   string // asOrg is the autonomous system's organization.
+	}
+
+	// keyCount is a count of requests for a key, e.g. a country.
+	keyCount struct {
+		Key   string `json:"key"`   // Key is what was counted.
+		Count int    `json:"count"` // Count is how many requests it had.
+	}
+)
+
+// geoCacheSize is how many lookups geoIP caches before starting over.
+const geoCacheSize = 4096
+
+// geo enriches entries with their country and network, nil unless -geoip or -asn is set.
+var geo *geoIP
+
+// newGeoIP returns a pointer to a new geoIP reading the database files at paths (empty paths are
+// skipped).
+func newGeoIP(paths ...string) (*geoIP, error) {
+	g := &geoIP{cache: map[string]geoInfo{}, tex: &sync.Mutex{}}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		db, err := openMMDB(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s - %s", path, err.Error())
+		}
+		g.dbs = append(g.dbs, db)
+	}
+	return g, nil
+}
+
+// enrich sets an entry's country and network from its remote host.
+func (g *geoIP) enrich(e *logEntry) {
+	info := g.lookup(clientHost(e.remoteHost))
+	e.country, e.asn, e.asOrg = info.country, info.asn, info.asOrg
+}
+
+// lookup returns what the databases know about host, which is empty for hostnames and unknown
+// addresses.
+func (g *geoIP) lookup(host string) geoInfo {
+	g.tex.Lock()
+	defer g.tex.Unlock()
+	if info, ok := g.cache[host]; ok {
+		return info
+	}
+	var info geoInfo
+	if ip := net.ParseIP(host); ip != nil {
+		for _, db := range g.dbs {
+			v, err := db.lookup(ip)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to look up %s in %s - %s\n", host, db.dbType, err.Error())
+				continue
+			}
+			info.fill(v)
+		}
+	}
+	if len(g.cache) >= geoCacheSize {
+		g.cache = map[string]geoInfo{}
+	}
+	g.cache[host] = info
+	return info
+}
+
+// fill sets any of the info's unset fields found in a database record. Countries are read from
+// country.iso_code (or registered_country.iso_code), networks from autonomous_system_number and
+// autonomous_system_organization.
+func (info *geoInfo) fill(v interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if info.country == "" {
+		for _, key := range []string{"country", "registered_country"} {
+			if c, ok := m[key].(map[string]interface{}); ok {
+				if code, ok := c["iso_code"].(string); ok && code != "" {
+					info.country = code
+					break
+				}
+			}
+		}
+	}
+	if info.asn == 0 {
+		info.asn = int(toUint(m["autonomous_system_number"]))
+		info.asOrg, _ = m["autonomous_system_organization"].(string)
+	}
+}
+
+// network returns an entry's autonomous system as "AS<number> <organization>", or "" if unknown.
+func (e logEntry) network() string {
+	if e.asn == 0 {
+		return ""
+	}
+	if e.asOrg == "" {
+		return fmt.Sprintf("AS%d", e.asn)
+	}
+	return fmt.Sprintf("AS%d %s", e.asn, e.asOrg)
+}
+
+// addGeo counts an entry toward its country and network for the interval.
+func (s *stats) addGeo(e logEntry) {
+	s.reqTex.Lock()
+	defer s.reqTex.Unlock()
+	if e.country != "" {
+		if s.countries == nil {
+			s.countries = map[string]int{}
+		}
+		s.countries[e.country]++
+	}
+	if n := e.network(); n != "" {
+		if s.networks == nil {
+			s.networks = map[string]int{}
+		}
+		s.networks[n]++
+	}
+}
+
+// topCounts returns the n keys of m with the highest counts.
+func topCounts(m map[string]int, n int) []keyCount {
+	out := make([]keyCount, 0, len(m))
+	for k, c := range m {
+		out = append(out, keyCount{Key: k, Count: c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// printGeo prints the top countries and networks to w.
+func (s stats) printGeo(w io.Writer) {
+	for _, t := range []struct {
+		title  string
+		counts []keyCount
+	}{{"Countries:", s.topCountries}, {"Networks:", s.topNetworks}} {
+		if len(t.counts) == 0 {
+			continue
+		}
+		fmt.Fprintln(w, t.title)
+		for _, c := range t.counts {
+			fmt.Fprintf(w, "%3d %s\n", c.Count, c.Key)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journal is an append-only file of alert transitions, one json object per line. Every line is
+// synced to disk, so the history survives crashes and restarts.
+type journal struct {
+	f   *os.File    // f is the open journal.
+	tex *sync.Mutex // tex serializes writes.
+}
+
+// openJournal opens (creating if needed) the journal at path for appending.
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{f: f, tex: &sync.Mutex{}}, nil
+}
+
+// report allows journal to implement the sink interface.
+func (j *journal) report(s stats) {}
+
+// alert allows journal to implement the sink interface.
+func (j *journal) alert(a alertEvent) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to journal alert - %s\n", err.Error())
+		return
+	}
+	j.tex.Lock()
+	defer j.tex.Unlock()
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to journal alert - %s\n", err.Error())
+		return
+	}
+	if err := j.f.Sync(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to sync journal - %s\n", err.Error())
+	}
+}
+
+// readJournal returns the transitions in the journal at path, oldest first. Lines that can't be
+// parsed (like one torn by a crash) are skipped.
+func readJournal(path string) ([]alertEvent, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []alertEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var a alertEvent
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping journal line %q - %s\n", scanner.Text(), err.Error())
+			continue
+		}
+		out = append(out, a)
+	}
+	return out, scanner.Err()
+}
+
+// firingAlerts returns the last transition of every rule whose last transition triggered, by rule.
+// Security alerts are per client and aren't resumed, so they're left out.
+func firingAlerts(history []alertEvent) map[string]alertEvent {
+	firing := map[string]alertEvent{}
+	for i := range history {
+		if history[i].RemoteHost != "" {
+			continue
+		}
+		if history[i].Triggered {
+			firing[history[i].Rule] = history[i]
+		} else {
+			delete(firing, history[i].Rule)
+		}
+	}
+	return firing
+}
+
+// listHistory writes the journaled transitions whose rule contains rule (ignoring case) and whose
+// time is within since and until (either may be zero) to w.
+func listHistory(w io.Writer, path, rule string, since, until time.Time) error {
+	history, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+	rule = strings.ToLower(rule)
+	for i := range history {
+		a := history[i]
+		if !strings.Contains(strings.ToLower(a.Rule), rule) ||
+			(!since.IsZero() && a.Time.Before(since)) || (!until.IsZero() && a.Time.After(until)) {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", a.Time.Format("2006-01-02"), a.message()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseWhen parses a time given as RFC3339 or as a duration before now, e.g. "2h". Empty is zero.
+func parseWhen(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
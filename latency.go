@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// latencySketch is a mergeable histogram of durations in logarithmic buckets, so quantiles are
+	// within 1% of the truth while memory stays bounded by the range of durations, not their count.
+	latencySketch struct {
+		counts map[int]int64 // counts are how many durations fell in each bucket.
+		zero   int64         // zero is how many durations were under a microsecond.
+		count  int64         // count is how many durations were added.
+		max    time.Duration // max is the largest duration added.
+	}
+
+	// latencySummary is a sketch's quantiles, in milliseconds.
+	latencySummary struct {
+		Count int64   `json:"count"` // Count is how many requests were timed.
+		P50   float64 `json:"p50"`   // P50 is the median duration.
+		P90   float64 `json:"p90"`   // P90 is the 90th percentile duration.
+		P99   float64 `json:"p99"`   // P99 is the 99th percentile duration.
+		Max   float64 `json:"max"`   // Max is the longest duration.
+	}
+
+	// latencyMon alerts on a quantile of request durations over a sliding window, kept as one
+	// sketch per second.
+	latencyMon struct {
+		alert *satMon          // alert holds the rule's settings, filters, and alert state.
+		slots []*latencySketch // slots are the sketches for each second of the window, as a ring.
+		cur   int              // cur is the slot for the current second.
+		tex   *sync.Mutex      // tex is slots' and cur's lock.
+	}
+)
+
+// latencyGamma is the ratio between latencySketch bucket bounds. Estimates are off by at most
+// (gamma-1)/(gamma+1).
+const latencyGamma = 1.02
+
+// latencyUnits are how many of each -latency unit are in a duration.
+var latencyUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+}
+
+// newLatencySketch returns a pointer to a new, empty latencySketch.
+func newLatencySketch() *latencySketch {
+	return &latencySketch{counts: map[int]int64{}}
+}
+
+// add adds a duration to the sketch.
+func (ls *latencySketch) add(d time.Duration) {
+	ls.count++
+	if d > ls.max {
+		ls.max = d
+	}
+	us := float64(d) / float64(time.Microsecond)
+	if us < 1 {
+		ls.zero++
+		return
+	}
+	ls.counts[int(math.Ceil(math.Log(us)/math.Log(latencyGamma)))]++
+}
+
+// merge adds all of o's durations to the sketch.
+func (ls *latencySketch) merge(o *latencySketch) {
+	for i, n := range o.counts {
+		ls.counts[i] += n
+	}
+	ls.zero += o.zero
+	ls.count += o.count
+	if o.max > ls.max {
+		ls.max = o.max
+	}
+}
+
+// quantile returns an estimate of the q quantile (0 to 1) of the durations, 0 if there are none.
+func (ls *latencySketch) quantile(q float64) time.Duration {
+	if ls.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(ls.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := ls.zero
+	if seen >= rank {
+		return 0
+	}
+	keys := make([]int, 0, len(ls.counts))
+	for i := range ls.counts {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	for _, i := range keys {
+		seen += ls.counts[i]
+		if seen >= rank {
+			// the middle of the bucket, (gamma^(i-1), gamma^i]
+			d := time.Duration(2 * math.Pow(latencyGamma, float64(i)) / (latencyGamma + 1) * float64(time.Microsecond))
+			if d > ls.max {
+				d = ls.max
+			}
+			return d
+		}
+	}
+	return ls.max
+}
+
+// summary returns the sketch's quantiles.
+func (ls *latencySketch) summary() latencySummary {
+	return latencySummary{
+		Count: ls.count,
+		P50:   millis(ls.quantile(0.5)),
+		P90:   millis(ls.quantile(0.9)),
+		P99:   millis(ls.quantile(0.99)),
+		Max:   millis(ls.max),
+	}
+}
+
+// millis returns d in milliseconds.
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// parseLatency parses a request duration field in unit (s, ms, or us).
+func parseLatency(field, unit string) (time.Duration, bool) {
+	per, ok := latencyUnits[unit]
+	if !ok || field == "" {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(field, 64)
+	if err != nil || f < 0 {
+		return 0, false
+	}
+	return time.Duration(f * float64(per)), true
+}
+
+// isLatencyMetric returns true if metric is a request duration quantile.
+func isLatencyMetric(metric string) bool {
+	return metric == "p50" || metric == "p90" || metric == "p99" || metric == "max"
+}
+
+// newLatencyMonitor returns a pointer to a new latencyMon for a parsed rule whose metric is a
+// latency quantile. The rule's threshold is in milliseconds.
+func newLatencyMonitor(r *satMon) *latencyMon {
+	slots := make([]*latencySketch, int(r.ttl/time.Second))
+	for i := range slots {
+		slots[i] = newLatencySketch()
+	}
+	return &latencyMon{alert: r, slots: slots, tex: &sync.Mutex{}}
+}
+
+// observe allows latencyMon to implement the rule interface.
+func (lm *latencyMon) observe(e logEntry) {
+	r := lm.alert
+	if !e.timed || !r.matches(e) {
+		return
+	}
+	lm.tex.Lock()
+	defer lm.tex.Unlock()
+	lm.slots[lm.cur].add(e.duration)
+}
+
+// seen allows latencyMon to implement the rule interface.
+func (lm *latencyMon) seen() {}
+
+// restore allows latencyMon to implement the rule interface.
+func (lm *latencyMon) restore(firing map[string]alertEvent) {
+	lm.alert.restore(firing)
+}
+
+// monitor allows latencyMon to implement the rule interface.
+func (lm *latencyMon) monitor(ctx context.Context) {
+	atomic.StoreInt64(&lm.alert.started, time.Now().UnixNano())
+	for {
+		select {
+		default:
+			if e := lm.alert.step(time.Now(), lm.value()); e != nil {
+				outputs.alert(*e)
+			}
+
+			<-time.After(time.Second)
+			lm.advance()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// value returns the rule's quantile over the window, in milliseconds.
+func (lm *latencyMon) value() float64 {
+	lm.tex.Lock()
+	defer lm.tex.Unlock()
+	window := newLatencySketch()
+	for i := range lm.slots {
+		window.merge(lm.slots[i])
+	}
+	switch lm.alert.metric {
+	case "p50":
+		return millis(window.quantile(0.5))
+	case "p90":
+		return millis(window.quantile(0.9))
+	case "p99":
+		return millis(window.quantile(0.99))
+	}
+	return millis(window.max)
+}
+
+// advance moves to the next second's slot, dropping the oldest second.
+func (lm *latencyMon) advance() {
+	lm.tex.Lock()
+	defer lm.tex.Unlock()
+	lm.cur = (lm.cur + 1) % len(lm.slots)
+	lm.slots[lm.cur] = newLatencySketch()
+}
+
+// addLatency adds a timed entry's duration to the overall and section sketches.
+func (s *stats) addLatency(e logEntry) {
+	s.reqTex.Lock()
+	defer s.reqTex.Unlock()
+	if s.latencies == nil {
+		s.latencies = map[string]*latencySketch{}
+	}
+	for _, key := range []string{"", sectionOf(e.request.path)} {
+		if s.latencies[key] == nil {
+			s.latencies[key] = newLatencySketch()
+		}
+		s.latencies[key].add(e.duration)
+	}
+}
+
+// latencySummaries returns the overall ("") and per section latency quantiles.
+func (s stats) latencySummaries() map[string]latencySummary {
+	out := map[string]latencySummary{}
+	for key, ls := range s.latencies {
+		out[key] = ls.summary()
+	}
+	return out
+}
+
+// printLatency prints the latency quantiles to w, overall and for each section.
+func (s stats) printLatency(w io.Writer) {
+	if len(s.latencies) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Latency (p50/p90/p99/max ms):")
+	sums := s.latencySummaries()
+	keys := make([]string, 0, len(sums))
+	for key := range sums {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		l, name := sums[key], key
+		if name == "" {
+			name = "all"
+		}
+		fmt.Fprintf(w, " %.1f/%.1f/%.1f/%.1f %s\n", l.P50, l.P90, l.P99, l.Max, name)
+	}
+	fmt.Fprintln(w)
+}
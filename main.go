@@ -4,22 +4,143 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
 	// configurable options
-	logSource       string // logSource is the location of the log to watch and analyze.
-	reportFrequency int    // reportFrequency is how frequent a summary will be printed to the screen.
-	psLimit         int    // psLimit is the threshold for things (requests) per second.
-	duration        int    // duration is the size of the monitoring window. Will also serve us as the ttl.
+	logSource       string        // logSource is the location of the log to watch and analyze.
+	reportFrequency int           // reportFrequency is how frequent a summary will be printed to the screen.
+	psLimit         int           // psLimit is the threshold for things (requests) per second.
+	duration        int           // duration is the size of the monitoring window. Will also serve us as the ttl.
+	httpAddr        string        // httpAddr is the address to serve the dashboard and live feed on (disabled if empty).
+	useTui          bool          // useTui is whether to show the full-screen terminal dashboard.
+	outputSpecs     listFlag      // outputSpecs are where to send reports and alerts, as "format[:destination]".
+	rotateSize      int           // rotateSize is the size in megabytes at which output files are rotated.
+	rotateAge       time.Duration // rotateAge is how long output files are written before being rotated.
+	rotateKeep      int           // rotateKeep is how many rotated output files to retain.
+	rotateGzip      bool          // rotateGzip is whether to gzip rotated output files.
+	ruleSpecs       listFlag      // ruleSpecs are additional alert rules, as comma separated key=value settings.
+	errRatio        float64       // errRatio is the threshold for the fraction of responses that are errors.
+	errMin          int           // errMin is how many requests the window needs before the error ratio can alert.
+	errWith4xx      bool          // errWith4xx is whether 4xx responses count as errors.
+	lowLimit        float64       // lowLimit is the requests per second below which traffic is low.
+	idleLimit       int           // idleLimit is how many seconds without reading a line before alerting.
+	recoverLimit    float64       // recoverLimit is the requests per second below which high traffic recovers.
+	alertFor        time.Duration // alertFor is how long alert conditions must hold before firing or resolving.
+	sectionSpecs    listFlag      // sectionSpecs are per-section thresholds, as "section=requests per second".
+	sectionLimit    float64       // sectionLimit is the requests per second any one section may have.
+	sectionTop      int           // sectionTop is how many of the busiest sections sectionLimit tracks.
+	anomalyLimit    float64       // anomalyLimit is how many standard deviations from the baseline traffic is anomalous.
+	anomalyWarmup   int           // anomalyWarmup is how many -f intervals the baseline learns before alerting.
+	anomalySeasonal bool          // anomalySeasonal is whether the baseline models a daily cycle.
+	webhookSpecs    listFlag      // webhookSpecs are where to post alert transitions, as "[template=]url".
+	webhookRetries  int           // webhookRetries is how many times a failed webhook post is retried.
+	webhookTimeout  time.Duration // webhookTimeout is how long a webhook post may take.
+	execCommand     string        // execCommand is a shell command to run on alert transitions (disabled if empty).
+	execTimeout     time.Duration // execTimeout is how long execCommand may run.
+	execLimit       int           // execLimit is how many execCommands may run at once.
+	journalPath     string        // journalPath is the file alert transitions are journaled to (disabled if empty).
+	history         bool          // history is whether to list the journal and exit.
+	historyRule     string        // historyRule limits the listing to rules containing it.
+	historySince    string        // historySince limits the listing to transitions after it.
+	historyUntil    string        // historyUntil limits the listing to transitions before it.
+	silenceSpecs    listFlag      // silenceSpecs are silences, as comma separated key=value settings.
+	silenceFile     string        // silenceFile is a file of silences, one per line, reloaded on SIGHUP.
+	sloObjective    float64       // sloObjective is the target fraction of responses that aren't 5xx (disabled if 0).
+	sloPeriod       time.Duration // sloPeriod is how long the objective covers.
+	latencyUnit     string        // latencyUnit is the unit of the request duration in each line's last field (not parsed if empty).
+	topClients      int           // topClients is how many of the heaviest clients reports and high traffic alerts show.
+	clientPrefix    bool          // clientPrefix is whether clients are counted by /24 (IPv4) and /64 (IPv6) network.
+	forwardedField  int           // forwardedField is which quoted field after the bytes holds X-Forwarded-For or X-Real-IP (not resolved if 0).
+	proxySpecs      listFlag      // proxySpecs are the trusted proxy networks, as comma separated CIDRs or addresses.
+	geoPath         string        // geoPath is the MaxMind country or city database (disabled if empty).
+	asnPath         string        // asnPath is the MaxMind ASN database (disabled if empty).
+	geoTop          int           // geoTop is how many of the busiest countries and networks reports show.
+	uaRulesFile     string        // uaRulesFile is a file of user agent rules replacing the built in ones, reloaded on SIGHUP.
+	siteSpecs       listFlag      // siteSpecs are this site's hosts, as comma separated lists.
+	hotlinkRatio    float64       // hotlinkRatio is the fraction of a section's static assets linked from other sites that flags it (disabled if 0).
+	scanLimit       int           // scanLimit is how many distinct paths a client may get 404s for within securityWindow (disabled if 0).
+	bruteLimit      int           // bruteLimit is how many 401 or 403 responses on auth paths a client may get within securityWindow (disabled if 0).
+	authPathSpec    string        // authPathSpec are the auth paths bruteLimit watches, as a comma separated list.
+	injection       bool          // injection is whether to alert on requests matching SQL injection, XSS, or path traversal signatures.
+	securityWindow  time.Duration // securityWindow is how long a client's suspicious requests count toward security alerts.
+	banSpecs        listFlag      // banSpecs are the block lists to maintain, as "format:file".
+	banTTL          time.Duration // banTTL is how long a client stays on the block lists after its alert recovered.
+	banTop          int           // banTop is how many of a high traffic alert's top clients are blocked.
 )
 
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+// console is where plain output is written. It is discarded while the terminal dashboard is shown.
+var console io.Writer = os.Stdout
+
 func init() {
+	flag.StringVar(&httpAddr, "a", "", "Address to serve the dashboard and live event feed on, e.g. ':8080' (disabled if empty).")
+	flag.Float64Var(&anomalyLimit, "anomaly", 0, "Number of standard deviations the requests in a -f interval may be from the learned baseline before printing an alert, e.g. 4 (disabled if 0).")
+	flag.BoolVar(&anomalySeasonal, "anomaly-seasonal", false, "Learn a daily cycle for -anomaly. Alerting starts after a day.")
+	flag.IntVar(&anomalyWarmup, "anomaly-warmup", 30, "Number of -f intervals -anomaly learns before it can alert.")
+	flag.BoolVar(&clientPrefix, "client-prefix", false, "Count -clients by /24 (IPv4) and /64 (IPv6) network rather than by address.")
+	flag.IntVar(&topClients, "clients", 0, "Number of the heaviest clients (by remote host) to show in reports and high traffic alerts (disabled if 0).")
+	flag.StringVar(&asnPath, "asn", "", "MaxMind ASN database file (.mmdb) to count requests per autonomous system with. Lookups are local (disabled if empty).")
+	flag.StringVar(&authPathSpec, "auth-paths", "/login,/signin,/auth,/admin,/wp-login.php,/wp-admin,/xmlrpc.php,/user/login,/api/login,/oauth", "Auth paths -bruteforce watches, as a comma separated list. Paths under them count too.")
+	flag.Var(&banSpecs, "ban", "Maintain a block list of the clients security alerts flag as format:file, for other tooling to enforce. Formats are plain (one address per line), nginx (deny directives), and ipset (ipset restore input for the bver-ban and bver-ban6 sets). The file is rewritten atomically on change, and bver never changes firewall rules itself. May be repeated.")
+	flag.IntVar(&banTop, "ban-top", 0, "Number of a high traffic alert's top clients to add to the -ban lists too (none if 0).")
+	flag.DurationVar(&banTTL, "ban-ttl", time.Hour, "How long a client stays on the -ban lists after the alert that flagged it recovered.")
+	flag.IntVar(&bruteLimit, "bruteforce", 0, "Number of 401 or 403 responses on -auth-paths a client may get within -security-window before printing a credential stuffing alert naming it (disabled if 0).")
 	flag.IntVar(&duration, "d", 120, "Duration of window in which to average requests per second.")
+	flag.Float64Var(&errRatio, "e", 0, "Fraction of responses that are 5xx within the -d window before printing an alert, e.g. 0.05 (disabled if 0).")
+	flag.BoolVar(&errWith4xx, "error-4xx", false, "Count 4xx responses as errors for -e.")
+	flag.IntVar(&errMin, "error-min", 20, "Number of requests within the -d window before -e can alert.")
+	flag.StringVar(&execCommand, "exec", "", "Shell command to run when an alert triggers or recovers. It gets BVER_RULE, BVER_METRIC, BVER_SECTION, BVER_REMOTE_HOST (security alerts), BVER_STATUS, BVER_VALUE, BVER_OP, BVER_THRESHOLD, and BVER_TIME, and the json event on stdin (disabled if empty).")
+	flag.IntVar(&execLimit, "exec-limit", 4, "Number of -exec commands that may run at once.")
+	flag.DurationVar(&execTimeout, "exec-timeout", 10*time.Second, "How long an -exec command may run before it is killed.")
 	flag.IntVar(&reportFrequency, "f", 10, "Frequency at which to print summary (seconds).")
+	flag.DurationVar(&alertFor, "for", 0, "How long an alert's condition must hold before it fires or recovers, e.g. '30s'.")
+	flag.IntVar(&forwardedField, "forwarded", 0, "Position of the logged X-Forwarded-For or X-Real-IP header among the quoted fields after the bytes, e.g. 3 for nginx's combined format followed by \"$http_x_forwarded_for\". The client it resolves to (see -trusted-proxy) replaces the remote host (disabled if 0).")
+	flag.IntVar(&geoTop, "geo-top", 10, "Number of the busiest countries and networks to show in reports.")
+	flag.StringVar(&geoPath, "geoip", "", "MaxMind country or city database file (.mmdb) to count requests per country with, and scope rules by country. Lookups are local (disabled if empty).")
+	flag.BoolVar(&history, "history", false, "List the alerts in -journal and exit.")
+	flag.StringVar(&historyRule, "history-rule", "", "List only alerts whose rule contains this.")
+	flag.StringVar(&historySince, "history-since", "", "List only alerts since this time, as RFC3339 or a duration ago, e.g. '24h'.")
+	flag.StringVar(&historyUntil, "history-until", "", "List only alerts until this time, as RFC3339 or a duration ago.")
+	flag.Float64Var(&hotlinkRatio, "hotlink", 0.5, "Fraction of a section's static asset requests (at least 10 in a -f interval) with referers from other sites, above which the section is flagged as possibly hotlinked. Needs -site (disabled if 0).")
+	flag.IntVar(&idleLimit, "idle", 0, "Number of seconds without reading a line from the log before printing an alert (disabled if 0).")
+	flag.BoolVar(&injection, "injection", false, "Print an alert naming any client whose request path matches a SQL injection, cross-site scripting, or path traversal signature.")
+	flag.StringVar(&journalPath, "journal", "", "File to journal alert transitions to, so alert history survives restarts (disabled if empty).")
 	flag.StringVar(&logSource, "l", "/var/log/access.log", "Log location to watch and analyze.")
+	flag.StringVar(&latencyUnit, "latency", "", "Unit of the request duration in the last field of each line: s (nginx $request_time), ms, or us (apache %D). Reports then show latency quantiles (disabled if empty).")
+	flag.Float64Var(&lowLimit, "low", 0, "Number of requests per second, averaged over the -d window, below which to print an alert (disabled if 0).")
+	flag.DurationVar(&rotateAge, "rotate-age", 0, "Rotate output files after writing to them this long, e.g. '24h' (never if 0).")
+	flag.BoolVar(&rotateGzip, "rotate-gzip", false, "Gzip rotated output files.")
+	flag.IntVar(&rotateKeep, "rotate-keep", 0, "Number of rotated output files to retain (all if 0).")
+	flag.IntVar(&rotateSize, "rotate-size", 0, "Rotate output files at this many megabytes (never if 0).")
+	flag.Var(&outputSpecs, "o", "Output reports and alerts as format[:destination]. Formats are text, json, csv, and prometheus (served at /metrics). Destination is stdout, stderr, or a file. May be repeated. (default text:stdout)")
+	flag.Float64Var(&recoverLimit, "recover", 0, "Number of requests per second below which the high traffic alert recovers. (default -t)")
+	flag.Var(&ruleSpecs, "r", "Add an alert rule, e.g. 'name=Login flood,section=/login,window=1m,threshold=50/s'. Settings are name, metric (hits, bytes, 5xx, errorRatio, idle, or the latency p50, p90, p99, max in ms), window, op (>=, >, <=, <), threshold, recover, for, recoverFor, section, status, country (see -geoip), bots (false ignores crawlers, bots, and http libraries), min, and with4xx. May be repeated.")
+	flag.Var(&sectionSpecs, "s", "Add a per-section threshold as section=requests per second, averaged over -d, e.g. '/login=50'. May be repeated.")
+	flag.IntVar(&scanLimit, "scan", 0, "Number of distinct paths a client may get 404s for within -security-window before printing a path scanning alert naming it (disabled if 0).")
+	flag.Float64Var(&sectionLimit, "section-limit", 0, "Number of requests per second, averaged over -d, any section without its own -s threshold may have before printing an alert (disabled if 0).")
+	flag.IntVar(&sectionTop, "section-top", 20, "Number of the busiest sections -section-limit tracks, and the prometheus output exports (the rest are counted as \"other\").")
+	flag.DurationVar(&securityWindow, "security-window", time.Minute, "How long a client's suspicious requests count toward -scan, -bruteforce, and -injection alerts. Alerts recover once a client stays under its threshold for it.")
+	flag.Var(&silenceSpecs, "silence", "Silence notifications (-w, -exec) for matching alerts, e.g. 'rule=High traffic*,for=2h,comment=load test'. Settings are rule, metric, section (* matches anything), start, end (RFC3339) or for, and comment. May be repeated.")
+	flag.StringVar(&silenceFile, "silence-file", "", "File of silences, one per line as for -silence, reloaded on SIGHUP.")
+	flag.Var(&siteSpecs, "site", "This site's hosts, as a comma separated list, e.g. 'example.com,cdn.example.net'. Referers from them or their subdomains are same-site, and others external. May be repeated.")
+	flag.Float64Var(&sloObjective, "slo", 0, "Availability objective as the fraction of responses that aren't 5xx, e.g. 0.999. Reports show the error budget left, and alerts fire when it burns 14.4x too fast over 1h and 5m, or 6x over 6h and 30m (disabled if 0).")
+	flag.DurationVar(&sloPeriod, "slo-period", 720*time.Hour, "How long the -slo objective covers, at least 6h.")
 	flag.IntVar(&psLimit, "t", 10, "Number of requests per second before printing an alert.")
+	flag.Var(&proxySpecs, "trusted-proxy", "Trust the -forwarded header from these proxies, as comma separated CIDRs or addresses, e.g. '10.0.0.0/8,2001:db8::/32'. May be repeated.")
+	flag.BoolVar(&useTui, "u", false, "Show a full-screen terminal dashboard (plain output is used if stdout isn't a terminal).")
+	flag.StringVar(&uaRulesFile, "ua-rules", "", "File of user agent rules, one per line as 'family name pattern', replacing the built in ones. Families are browser, mobile, crawler, bot, and library, and patterns are case insensitive regexps. Reloaded on SIGHUP.")
+	flag.Var(&webhookSpecs, "w", "Post alert transitions to a webhook as [template=]url, e.g. 'slack=https://hooks.slack.com/services/...'. Template is json (default), slack, or a text/template file. May be repeated.")
+	flag.IntVar(&webhookRetries, "webhook-retries", 3, "Number of times a failed webhook post is retried, with backoff.")
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", 5*time.Second, "How long a webhook post may take.")
 	flag.Parse()
 
 	sanitizeOpts()
@@ -37,33 +158,408 @@ func sanitizeOpts() {
 	if reportFrequency < 1 {
 		reportFrequency = 10
 	}
+	if errRatio < 0 || errRatio > 1 {
+		errRatio = 0
+	}
+	if errMin < 0 {
+		errMin = 20
+	}
+	if recoverLimit < 0 || recoverLimit > float64(psLimit) {
+		recoverLimit = 0
+	}
+	if alertFor < 0 {
+		alertFor = 0
+	}
+	if sectionLimit < 0 {
+		sectionLimit = 0
+	}
+	if anomalyLimit < 0 {
+		anomalyLimit = 0
+	}
+	if anomalyWarmup < 1 {
+		anomalyWarmup = 30
+	}
+	if sloObjective < 0 || sloObjective >= 1 {
+		sloObjective = 0
+	}
+	if sloPeriod < 6*time.Hour {
+		sloPeriod = 720 * time.Hour
+	}
+	if forwardedField < 0 {
+		forwardedField = 0
+	}
+	if scanLimit < 0 {
+		scanLimit = 0
+	}
+	if bruteLimit < 0 {
+		bruteLimit = 0
+	}
+	if securityWindow <= 0 {
+		securityWindow = time.Minute
+	}
+	if banTTL <= 0 {
+		banTTL = time.Hour
+	}
+	if banTop < 0 {
+		banTop = 0
+	}
+	if hotlinkRatio < 0 || hotlinkRatio > 1 {
+		hotlinkRatio = 0.5
+	}
+	if geoTop < 1 {
+		geoTop = 10
+	}
+	if topClients < 0 {
+		topClients = 0
+	}
+	if sectionTop < 1 {
+		sectionTop = 20
+	}
+	if lowLimit < 0 {
+		lowLimit = 0
+	}
+	if idleLimit < 0 {
+		idleLimit = 0
+	}
+	if webhookRetries < 0 {
+		webhookRetries = 3
+	}
+	if webhookTimeout <= 0 {
+		webhookTimeout = 5 * time.Second
+	}
+	if execLimit < 1 {
+		execLimit = 4
+	}
+	if execTimeout <= 0 {
+		execTimeout = 10 * time.Second
+	}
+	if rotateSize < 0 {
+		rotateSize = 0
+	}
+	if rotateAge < 0 {
+		rotateAge = 0
+	}
+	if rotateKeep < 0 {
+		rotateKeep = 0
+	}
+	if _, ok := latencyUnits[latencyUnit]; !ok && latencyUnit != "" {
+		fmt.Fprintf(os.Stderr, "Unknown latency unit %q, not parsing latency\n", latencyUnit)
+		latencyUnit = ""
+	}
+	if len(outputSpecs) == 0 {
+		outputSpecs = listFlag{"text:stdout"}
+	}
 	if _, err := os.Stat(logSource); os.IsNotExist(err) {
 		// ignore error since tailer retries
 		os.Create(logSource)
 	}
 }
 
+// String allows listFlag to implement the flag.Value interface.
+func (lf *listFlag) String() string {
+	return strings.Join(*lf, " ")
+}
+
+// Set allows listFlag to implement the flag.Value interface.
+func (lf *listFlag) Set(v string) error {
+	*lf = append(*lf, v)
+	return nil
+}
+
+// setupRules returns the high traffic rule, the high error rate, low traffic, no traffic, traffic
+// anomaly, SLO, security, and any section rules (if enabled), and any configured section and custom
+// rules.
+func setupRules() rules {
+	rs := rules{newSaturationMonitor()}
+	if errRatio > 0 {
+		rs = append(rs, newErrorMonitor())
+	}
+	if lowLimit > 0 {
+		rs = append(rs, newLowTrafficMonitor())
+	}
+	if idleLimit > 0 {
+		rs = append(rs, newIdleMonitor())
+	}
+	if anomalyLimit > 0 {
+		rs = append(rs, newAnomalyMonitor())
+	}
+	if sloObjective > 0 {
+		objective = newSLOMonitor()
+		rs = append(rs, objective)
+	}
+	if scanLimit > 0 || bruteLimit > 0 || injection {
+		rs = append(rs, newSecurityMonitor())
+	}
+	if topClients > 0 {
+		contributors = newClientWindow(duration, reportFrequency)
+	}
+	// alerts are resumed by rule name, so names must be unique
+	names := map[string]bool{}
+	for _, name := range rs.names() {
+		names[name] = true
+	}
+	configured := map[string]bool{}
+	for _, spec := range sectionSpecs {
+		r, err := parseSectionLimit(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping section threshold %q - %s\n", spec, err.Error())
+			continue
+		}
+		if names[r.name] {
+			fmt.Fprintf(os.Stderr, "Skipping section threshold %q - Duplicate rule name %q\n", spec, r.name)
+			continue
+		}
+		names[r.name] = true
+		configured[r.section] = true
+		rs = append(rs, r)
+	}
+	if sectionLimit > 0 {
+		rs = append(rs, newSectionMonitor(configured))
+	}
+	for _, spec := range ruleSpecs {
+		r, err := parseRule(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping rule %q - %s\n", spec, err.Error())
+			continue
+		}
+		if names[r.name] {
+			fmt.Fprintf(os.Stderr, "Skipping rule %q - Duplicate rule name %q\n", spec, r.name)
+			continue
+		}
+		names[r.name] = true
+		if isLatencyMetric(r.metric) {
+			rs = append(rs, newLatencyMonitor(r))
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// setupOutputs adds the terminal dashboard (if shown), the live feed (if served), and the configured
+// outputs, webhooks, alert command, ban lists, and journal to outputs.
+func setupOutputs(ui *tui) {
+	if ui != nil {
+		outputs.add("terminal", ui)
+	}
+	if httpAddr != "" {
+		outputs.add("feed", feedSink{events})
+	}
+	for _, spec := range outputSpecs {
+		if spec == "prometheus" {
+			if httpAddr == "" {
+				fmt.Fprintln(os.Stderr, "The prometheus output needs -a to be served")
+			}
+			metrics = newPromSink()
+			outputs.add(spec, metrics)
+			continue
+		}
+		s, err := newSink(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping output %q - %s\n", spec, err.Error())
+			continue
+		}
+		outputs.add(spec, s)
+	}
+	for _, spec := range webhookSpecs {
+		s, err := newWebhookSink(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping webhook %q - %s\n", spec, err.Error())
+			continue
+		}
+		outputs.add("webhook "+s.url, notifier{s})
+	}
+	if execCommand != "" {
+		outputs.add("exec", notifier{newCommandSink(execCommand, execTimeout, execLimit)})
+	}
+	for _, spec := range banSpecs {
+		b, err := newBanList(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping ban list %q - %s\n", spec, err.Error())
+			continue
+		}
+		outputs.addLossless("ban list "+b.path, b)
+	}
+	if journalPath != "" {
+		if j, err := openJournal(journalPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping journal - %s\n", err.Error())
+		} else {
+			outputs.addLossless("journal", j)
+		}
+	}
+}
+
+// setupProxies parses the -trusted-proxy networks.
+func setupProxies() {
+	for _, spec := range proxySpecs {
+		ns, err := parseTrustedProxies(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping trusted proxies %q - %s\n", spec, err.Error())
+			continue
+		}
+		trustedProxies = append(trustedProxies, ns...)
+	}
+	if forwardedField > 0 && len(trustedProxies) == 0 {
+		fmt.Fprintf(os.Stderr, "No -trusted-proxy set, so -forwarded headers are ignored\n")
+	}
+}
+
+// setupGeo opens the -geoip and -asn databases.
+func setupGeo() {
+	if geoPath == "" && asnPath == "" {
+		return
+	}
+	g, err := newGeoIP(geoPath, asnPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipping geoip - %s\n", err.Error())
+		return
+	}
+	geo = g
+}
+
+// setupSites parses the -site hosts.
+func setupSites() {
+	for _, spec := range siteSpecs {
+		for _, h := range strings.Split(spec, ",") {
+			if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+				siteHosts = append(siteHosts, h)
+			}
+		}
+	}
+}
+
+// setupAgents loads the -ua-rules file.
+func setupAgents() {
+	if uaRulesFile == "" {
+		return
+	}
+	if err := agents.load(uaRulesFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load user agent rules - %s\n", err.Error())
+	}
+}
+
+// setupSilences adds the -silence silences and loads the silence file.
+func setupSilences() {
+	now := time.Now()
+	for _, spec := range silenceSpecs {
+		s, err := parseSilence(spec, now)
+		if err == nil {
+			_, err = silences.add(s, "flag")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping silence %q - %s\n", spec, err.Error())
+		}
+	}
+	if silenceFile != "" {
+		if err := silences.load(silenceFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load silences - %s\n", err.Error())
+		}
+	}
+}
+
+// showHistory lists the journaled alerts matching the -history flags.
+func showHistory() error {
+	if journalPath == "" {
+		return fmt.Errorf("-history needs -journal")
+	}
+	now := time.Now()
+	since, err := parseWhen(historySince, now)
+	if err != nil {
+		return err
+	}
+	until, err := parseWhen(historyUntil, now)
+	if err != nil {
+		return err
+	}
+	return listHistory(os.Stdout, journalPath, historyRule, since, until)
+}
+
+// restoreRules resumes the rules that were still firing according to the journal (if any), so they
+// aren't announced again.
+func restoreRules(rs rules) {
+	if journalPath == "" {
+		return
+	}
+	history, err := readJournal(journalPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read journal - %s\n", err.Error())
+		return
+	}
+	firing := firingAlerts(history)
+	if len(firing) > 0 {
+		fmt.Fprintf(console, "Restored %d firing alerts\n", len(firing))
+	}
+	rs.restore(firing)
+}
+
 func main() {
+	if history {
+		if err := showHistory(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list history - %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	// resolve clients behind load balancers
+	setupProxies()
+	setupGeo()
+	setupAgents()
+	setupSites()
+
 	outChan := make(chan string)
 	entries := make(chan logEntry)
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// watch the logfile
 	go tail(ctx, logSource, outChan)
 
+	// take over the terminal
+	var ui *tui
+	if useTui && isTerminal(os.Stdout) {
+		ui = newTui(duration)
+		console = ioutil.Discard
+		go ui.run(ctx, cancel)
+	}
+
+	// configure where reports and alerts go
+	setupSilences()
+	setupOutputs(ui)
+	defer outputs.close()
+
+	// serve the dashboard and live feed
+	if httpAddr != "" {
+		go serve(ctx, httpAddr)
+	}
+
 	// collect and show statistics
-	go buildReport(ctx, entries, newSaturationMonitor(), reportFrequency)
+	rs := setupRules()
+	restoreRules(rs)
+	go buildReport(ctx, entries, rs, reportFrequency)
 
 	// parse log entries and send to report
 	for {
 		select {
 		case m := <-outChan:
+			rs.seen()
 			e, err := parseLine(m)
 			if err != nil {
 				continue
 			}
-			entries <- e
+			if geo != nil {
+				geo.enrich(&e)
+			}
+			if ui != nil {
+				ui.hit()
+			}
+			events.publishEntry(e)
+			select {
+			case entries <- e:
+			case <-ctx.Done():
+				return
+			}
 		case <-ctx.Done():
 			return
 		}
@@ -1,9 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -93,10 +106,10 @@ func TestReport(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	var f = func(s *satMon) {
-		s.threshold = int64(200)
+		s.threshold = 200
 	}
 
-	go buildReport(ctx, entries, newSaturationMonitor(f), 2)
+	go buildReport(ctx, entries, rules{newSaturationMonitor(f)}, 2)
 
 	for i := range logs {
 		e, err := parseLine(logs[i])
@@ -110,10 +123,10 @@ func TestReport(t *testing.T) {
 
 func TestSortPrint(t *testing.T) {
 	s := stats{}
-	s.print()
-	s.printRequest()
-	s.printResponse()
-	s.printTxBytes()
+	s.print(os.Stdout)
+	s.printRequest(os.Stdout)
+	s.printResponse(os.Stdout)
+	s.printTxBytes(os.Stdout)
 
 	r := resSlice{
 		response{count: 2, code: 202},
@@ -136,7 +149,7 @@ func TestSortPrint(t *testing.T) {
 }
 
 func TestSaturation(t *testing.T) {
-	thing := satMon{count: 0, threshold: int64(5)}
+	thing := satMon{count: 0, threshold: 5}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -149,6 +162,493 @@ func TestSaturation(t *testing.T) {
 	<-time.After(time.Millisecond * 1500)
 }
 
+func TestRules(t *testing.T) {
+	for _, bad := range []string{"metric=latency", "window=soon", "op=!=", "threshold=lots", "color=red", "name"} {
+		if _, err := parseRule(bad); err == nil {
+			t.Errorf("Failed to fail on rule %q", bad)
+		}
+	}
+
+	login, err := parseRule("name=Login flood,section=/login,window=10s,threshold=2/s")
+	if err != nil {
+		t.Errorf("Failed to parse rule - %s", err.Error())
+		t.FailNow()
+	}
+	if login.threshold != 20 || login.op != ">=" || login.metric != "hits" {
+		t.Errorf("Bad rule %+v", login)
+	}
+	ratio, _ := parseRule("name=Errors,metric=errorRatio,threshold=0.5")
+	bw, _ := parseRule("name=Bandwidth,metric=bytes,status=2xx,threshold=1000")
+	quiet, _ := parseRule("name=Quiet,op=<,threshold=1")
+	rs := rules{login, ratio, bw, quiet}
+
+	for i := 0; i < 25; i++ {
+		rs.observe(logEntry{request: requestEntry{path: "/login/submit"}, respCode: 200, txBytes: 100})
+	}
+	rs.observe(logEntry{request: requestEntry{path: "/"}, respCode: 503, txBytes: 100})
+
+	if !login.exceeded(login.value()) {
+		t.Errorf("Expected login rule to trigger at %v", login.value())
+	}
+	if v := ratio.value(); ratio.exceeded(v) || v != 1.0/26 {
+		t.Errorf("Expected error ratio 1/26, got %v", v)
+	}
+	if v := bw.value(); !bw.exceeded(v) || v != 2500 {
+		t.Errorf("Expected 2500 bytes from 2xx responses, got %v", v)
+	}
+	if quiet.exceeded(quiet.value()) {
+		t.Errorf("Expected quiet rule not to trigger")
+	}
+
+	e := login.event(true, login.value())
+	if e.message()[:40] != "Login flood generated an alert - hits = " {
+		t.Errorf("Unexpected message %q", e.message())
+	}
+
+	// alerts are resumed by name, so rules with a name that's taken are skipped
+	ruleSpecs = listFlag{"name=Login flood,threshold=1", "name=Login flood,threshold=2", "threshold=3"}
+	sectionSpecs = listFlag{"/api=1", "api/=2"}
+	defer func() { ruleSpecs, sectionSpecs = nil, nil }()
+	if names := strings.Join(setupRules().names(), ","); names != "High traffic,High traffic on /api,Login flood" {
+		t.Errorf("Expected duplicate rule names to be skipped, got %q", names)
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	r := newErrorMonitor(func(s *satMon) {
+		s.threshold = 0.5
+		s.minTotal = 4
+		s.with4xx = true
+	})
+
+	// too little traffic to alert on
+	r.observe(logEntry{respCode: 500})
+	r.observe(logEntry{respCode: 404})
+	if v := r.value(); v != 1 || r.exceeded(v) {
+		t.Errorf("Expected the minimum volume guard to hold at %v", v)
+	}
+
+	r.observe(logEntry{respCode: 200})
+	r.observe(logEntry{respCode: 200})
+	if v := r.value(); v != 0.5 || !r.exceeded(v) {
+		t.Errorf("Expected 0.5 to trigger, got %v", v)
+	}
+
+	r.observe(logEntry{respCode: 200})
+	if v := r.value(); r.exceeded(v) {
+		t.Errorf("Expected %v to recover", v)
+	}
+
+	if msg := r.event(true, 0.5).message(); !strings.HasPrefix(msg, "High error rate generated an alert - errorRatio = 0.500, triggered at ") {
+		t.Errorf("Unexpected message %q", msg)
+	}
+}
+
+func TestLowTraffic(t *testing.T) {
+	low := newLowTrafficMonitor(func(s *satMon) {
+		s.threshold = 5
+		s.ttl = time.Second * 10
+	})
+	low.started = time.Now().UnixNano()
+	if low.exceeded(low.value()) {
+		t.Errorf("Expected no alert while the first window fills")
+	}
+	low.started = time.Now().Add(-time.Second * 11).UnixNano()
+	if !low.exceeded(low.value()) {
+		t.Errorf("Expected an alert with no traffic")
+	}
+	for i := 0; i < 5; i++ {
+		low.observe(logEntry{respCode: 200})
+	}
+	if low.exceeded(low.value()) {
+		t.Errorf("Expected recovery once traffic resumes")
+	}
+
+	idle := newIdleMonitor(func(s *satMon) {
+		s.threshold = 1
+	})
+	if idle.exceeded(idle.value()) {
+		t.Errorf("Expected no alert before monitoring")
+	}
+	idle.started = time.Now().Add(-time.Second * 2).UnixNano()
+	if !idle.exceeded(idle.value()) {
+		t.Errorf("Expected an alert after 2 silent seconds, got %v", idle.value())
+	}
+	rules{idle}.seen()
+	if idle.exceeded(idle.value()) {
+		t.Errorf("Expected recovery once a line is read")
+	}
+	idle.observe(logEntry{respCode: 200})
+	if n := atomic.LoadInt64(&idle.count); n != 0 {
+		t.Errorf("Expected idle rules not to count entries, got %d", n)
+	}
+}
+
+// recordSink is a sink that records alerts.
+type recordSink struct{ alerts chan alertEvent }
+
+func (r recordSink) report(s stats)     {}
+func (r recordSink) alert(a alertEvent) { r.alerts <- a }
+
+func TestHysteresis(t *testing.T) {
+	thing := satMon{threshold: 10, recovery: 6, pendFor: time.Second * 2, resFor: time.Second * 2}
+	t0 := time.Now()
+	steps := []struct {
+		at    time.Duration
+		value float64
+		state alertState
+		fired bool // fired is true if the step should return an alert
+	}{
+		{0, 12, statePending, false},
+		{time.Second, 12, statePending, false},
+		{time.Millisecond * 1500, 5, stateInactive, false}, // didn't hold long enough
+		{time.Second * 2, 12, statePending, false},
+		{time.Second * 4, 12, stateFiring, true},
+		{time.Second * 5, 8, stateFiring, false}, // under the threshold, but not the recovery threshold
+		{time.Second * 6, 5, stateResolving, false},
+		{time.Second * 7, 7, stateFiring, false}, // didn't hold long enough
+		{time.Second * 8, 5, stateResolving, false},
+		{time.Second * 10, 5, stateInactive, true},
+	}
+	for i, st := range steps {
+		e := thing.step(t0.Add(st.at), st.value)
+		if (e != nil) != st.fired || thing.state != st.state {
+			t.Errorf("Step %d: expected %s (alert %v), got %s (alert %v)", i, st.state, st.fired, thing.state, e != nil)
+		}
+	}
+
+	// and end to end, like TestSaturation
+	rec := recordSink{make(chan alertEvent, 10)}
+	outputs.add("record", rec)
+	defer outputs.close()
+
+	live := satMon{count: 0, threshold: 5, recovery: 3, pendFor: time.Second, resFor: time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go live.monitor(ctx)
+	for i := 0; i < 6; i++ {
+		live.push(time.Second * 3)
+	}
+	<-time.After(time.Millisecond * 5500)
+	cancel()
+
+	var got []bool
+	for len(rec.alerts) > 0 {
+		got = append(got, (<-rec.alerts).Triggered)
+	}
+	if len(got) != 2 || !got[0] || got[1] {
+		t.Errorf("Expected an alert then a recovery, got %v", got)
+	}
+}
+
+func TestSectionThresholds(t *testing.T) {
+	login, err := parseSectionLimit("login/=2")
+	if err != nil || login.section != "/login" || login.threshold != float64(2*duration) {
+		t.Errorf("Failed to parse section threshold - %+v (%v)", login, err)
+	}
+	if _, err := parseSectionLimit("/login"); err == nil {
+		t.Errorf("Failed to fail on a missing threshold")
+	}
+
+	sm := newSectionMonitor(map[string]bool{"/login": true})
+	sm.threshold, sm.limit = 3, 2
+	hit := func(path string, n int) {
+		for i := 0; i < n; i++ {
+			sm.observe(logEntry{request: requestEntry{path: path}, respCode: 200})
+		}
+	}
+	hit("/a/1", 5)
+	hit("/b/1", 1)
+	hit("/login/1", 10)
+	hit("/c/1", 1)
+
+	var tracked []string
+	for section := range sm.mons {
+		tracked = append(tracked, section)
+	}
+	sort.Strings(tracked)
+	if strings.Join(tracked, " ") != "/a /c" {
+		t.Errorf("Expected the quietest section to be replaced and configured ones skipped, tracking %v", tracked)
+	}
+
+	// a firing section is never evicted
+	sm.mons["/a"].step(time.Now(), sm.mons["/a"].value())
+	e := sm.mons["/a"].event(true, sm.mons["/a"].value())
+	hit("/d/1", 1)
+	hit("/e/1", 1)
+	if _, ok := sm.mons["/a"]; !ok {
+		t.Errorf("Expected firing section to stay tracked")
+	}
+	if !strings.HasPrefix(e.message(), "High traffic on /a generated an alert - hits = 5") {
+		t.Errorf("Unexpected message %q", e.message())
+	}
+}
+
+func TestAnomaly(t *testing.T) {
+	a := newAnomalyMonitor(func(a *anomalyMon) {
+		a.alert.threshold = 4
+		a.warmup = 20
+	})
+	now := time.Now()
+	next := func(hits float64) *alertEvent {
+		now = now.Add(a.interval)
+		return a.evaluate(now, hits)
+	}
+	for i := 0; i < 40; i++ {
+		if e := next(float64(95 + i%3*5)); e != nil {
+			t.Fatalf("Unexpected alert while learning - %+v", e)
+		}
+	}
+
+	e := next(300)
+	if e == nil || !e.Triggered || e.Expected < 95 || e.Expected > 105 || e.Observed != 300 {
+		t.Fatalf("Expected an anomaly alert with the baseline, got %+v", e)
+	}
+	if !strings.HasPrefix(e.message(), "Traffic anomaly generated an alert - hits = 300, expected 10") {
+		t.Errorf("Unexpected message %q", e.message())
+	}
+	if e = next(100); e == nil || e.Triggered {
+		t.Errorf("Expected recovery, got %+v", e)
+	}
+
+	// a drop is as anomalous as a spike, once the spike is forgotten
+	for i := 0; i < 20; i++ {
+		next(100)
+	}
+	if e = next(0); e == nil || !e.Triggered {
+		t.Errorf("Expected an alert on a drop, got %+v", e)
+	}
+
+	// a daily cycle isn't anomalous once learned, but breaking it is
+	a = newAnomalyMonitor(func(a *anomalyMon) {
+		a.alert.threshold = 4
+		a.interval = time.Hour
+		a.seasonal = true
+	})
+	day := func(h int) float64 {
+		if h%24 < 12 {
+			return 100
+		}
+		return 1000
+	}
+	now = time.Unix(0, 0).Add(-a.interval)
+	for h := 0; h < 24*3; h++ {
+		if e := next(day(h)); e != nil {
+			t.Fatalf("Unexpected alert on the daily cycle at hour %d - %+v", h, e)
+		}
+	}
+	if e = next(1000); e == nil || !e.Triggered || e.Expected > 200 {
+		t.Errorf("Expected an alert on a busy night, got %+v", e)
+	}
+}
+
+func TestSLO(t *testing.T) {
+	m := newSLOMonitor(func(m *sloMon) {
+		m.objective = 0.99
+		m.period = 24 * time.Hour
+	})
+	start := time.Date(2018, 5, 4, 0, 0, 0, 0, time.UTC)
+	add := func(at time.Time, good, bad int) {
+		for i := 0; i < good; i++ {
+			m.add(at, 200)
+		}
+		for i := 0; i < bad; i++ {
+			m.add(at, 503)
+		}
+	}
+
+	// a quiet day with 0.5% errors burns half the budget
+	for min := 0; min < 20*60; min++ {
+		add(start.Add(time.Duration(min)*time.Minute), 199, 1)
+	}
+	now := start.Add(20 * time.Hour)
+	st := m.status(now)
+	if st.Remaining < 0.49 || st.Remaining > 0.51 || st.Burns["1h"] < 0.49 || st.Burns["1h"] > 0.51 {
+		t.Errorf("Unexpected budget %+v", st)
+	}
+	if e := m.step(now); len(e) != 0 {
+		t.Errorf("Unexpected burn alerts %+v", e)
+	}
+
+	// a 5 minute outage burns fast enough for both alerts
+	for min := 0; min < 5; min++ {
+		add(now.Add(time.Duration(min)*time.Minute), 0, 1000)
+	}
+	now = now.Add(4 * time.Minute)
+	if e := m.step(now); len(e) != 2 || e[0].Rule != "SLO fast burn" || !e[0].Triggered || !e[1].Triggered {
+		t.Errorf("Expected both burn alerts, got %+v", e)
+	}
+	// the fast one recovers once the 5m window is clean again, the slow one needs 30m
+	for min := 5; min < 11; min++ {
+		add(now.Add(time.Duration(min)*time.Minute), 200, 0)
+	}
+	if e := m.step(now.Add(10 * time.Minute)); len(e) != 1 || e[0].Rule != "SLO fast burn" || e[0].Triggered {
+		t.Errorf("Expected the fast burn alert to recover, got %+v", e)
+	}
+
+	// a restored burn alert keeps firing until its long window has been observed
+	m = newSLOMonitor()
+	m.restore(map[string]alertEvent{"SLO fast burn": {Rule: "SLO fast burn", Triggered: true, Time: time.Now()}})
+	if e := m.step(time.Now()); len(e) != 0 {
+		t.Errorf("Expected the restored alert not to recover with no data, got %+v", e)
+	}
+	m.burns[0].alert.started = time.Now().Add(-time.Hour).UnixNano()
+	if e := m.step(time.Now()); len(e) != 1 || e[0].Rule != "SLO fast burn" || e[0].Triggered {
+		t.Errorf("Expected the restored alert to recover after the long window, got %+v", e)
+	}
+
+	buf := &bytes.Buffer{}
+	st.print(buf)
+	if !strings.Contains(buf.String(), "remaining of 99% over 24h") {
+		t.Errorf("Unexpected budget output %q", buf.String())
+	}
+}
+
+func TestLatency(t *testing.T) {
+	latencyUnit = "s"
+	defer func() { latencyUnit = "" }()
+	e, _ := parseLine(logLine + ` "-" "curl/7.58.0" 0.250`)
+	if !e.timed || e.duration != 250*time.Millisecond {
+		t.Errorf("Failed to parse request duration - %v", e.duration)
+	}
+	if e, _ = parseLine(logLine); e.timed {
+		t.Errorf("Expected a line without a duration not to be timed, got %v", e.duration)
+	}
+	if e, _ = parseLine(logs[15]); e.timed {
+		t.Errorf("Expected a line ending in the user agent not to be timed, got %v", e.duration)
+	}
+
+	// quantiles are within the sketch's error, and merging is the same as adding
+	a, b := newLatencySketch(), newLatencySketch()
+	for i := 1; i <= 1000; i++ {
+		if i%2 == 0 {
+			a.add(time.Duration(i) * time.Millisecond)
+		} else {
+			b.add(time.Duration(i) * time.Millisecond)
+		}
+	}
+	a.merge(b)
+	for q, want := range map[float64]float64{0.5: 500, 0.9: 900, 0.99: 990, 1: 1000} {
+		if got := millis(a.quantile(q)); math.Abs(got-want)/want > 0.01 {
+			t.Errorf("Expected p%v near %vms, got %vms", q*100, want, got)
+		}
+	}
+
+	// reports summarize overall and per section
+	report := stats{reqTex: &sync.RWMutex{}, resTex: &sync.RWMutex{}, reportFreq: 10}
+	for i := 1; i <= 100; i++ {
+		path := "/api/x"
+		if i > 90 {
+			path = "/slow/x"
+		}
+		report.addRequest(request{section: path, count: 1})
+		report.addLatency(logEntry{request: requestEntry{path: path}, duration: time.Duration(i) * time.Millisecond, timed: true})
+	}
+	buf := &bytes.Buffer{}
+	report.snapshot().print(buf)
+	if !strings.Contains(buf.String(), "Latency (p50/p90/p99/max ms):\n 50.") || !strings.Contains(buf.String(), "/100.0 /slow") {
+		t.Errorf("Unexpected latency report %q", buf.String())
+	}
+	js, _ := report.snapshot().MarshalJSON()
+	if !strings.Contains(string(js), `"latency":{"all":{"count":100,`) {
+		t.Errorf("Unexpected latency json %s", js)
+	}
+
+	// latency rules alert on a quantile over their window
+	r, err := parseRule("name=Slow,metric=p99,window=2s,threshold=500ms")
+	if err != nil || r.threshold != 500 {
+		t.Fatalf("Failed to parse latency rule - %+v (%v)", r, err)
+	}
+	lm := newLatencyMonitor(r)
+	lm.observe(logEntry{request: requestEntry{path: "/"}, duration: time.Second, timed: true})
+	if e := lm.alert.step(time.Now(), lm.value()); e == nil || !e.Triggered || !strings.HasPrefix(e.message(), "Slow generated an alert - p99 = 99") {
+		t.Errorf("Expected a latency alert, got %+v", e)
+	}
+	lm.advance()
+	lm.advance()
+	if v := lm.value(); v != 0 {
+		t.Errorf("Expected the window to forget old durations, got %v", v)
+	}
+}
+
+func TestVisitors(t *testing.T) {
+	a, b := newHLL(), newHLL()
+	for i := 0; i < 20000; i++ {
+		a.add(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		a.add(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		b.add(fmt.Sprintf("10.1.%d.%d", i/256, i%256))
+	}
+	c := a.count()
+	if math.Abs(float64(c.Estimate-20000)) > 3*float64(c.Error) {
+		t.Errorf("Expected about 20000 unique visitors, got %+v", c)
+	}
+	a.merge(b)
+	if c = a.count(); math.Abs(float64(c.Estimate-40000)) > 3*float64(c.Error) {
+		t.Errorf("Expected about 40000 unique visitors after merging, got %+v", c)
+	}
+	small := newHLL()
+	for _, host := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "1.1.1.1"} {
+		small.add(host)
+	}
+	if c = small.count(); c.Estimate != 3 {
+		t.Errorf("Expected 3 unique visitors, got %+v", c)
+	}
+
+	// sketches stay sparse (and small) until many registers are set, and estimate the same either way
+	sparse := newHLL()
+	for i := 0; i < 100; i++ {
+		sparse.add(fmt.Sprintf("10.2.0.%d", i))
+	}
+	dense := &hll{registers: make([]uint8, 1<<hllPrecision)}
+	dense.merge(sparse)
+	if sparse.registers != nil || sparse.count() != dense.count() {
+		t.Errorf("Expected a sparse sketch estimating %+v, got %+v", dense.count(), sparse.count())
+	}
+	for i := 100; i < 1000; i++ {
+		sparse.add(fmt.Sprintf("10.2.%d.%d", i/256, i%256))
+	}
+	if c = sparse.count(); sparse.registers == nil || math.Abs(float64(c.Estimate-1000)) > 3*float64(c.Error) {
+		t.Errorf("Expected a dense sketch of about 1000 visitors, got %+v", c)
+	}
+
+	// the window forgets intervals that slid out of it
+	vw := newVisitorWindow(20, 10)
+	vw.add("1.1.1.1")
+	vw.advance()
+	vw.add("2.2.2.2")
+	if c = vw.count(); c.Estimate != 2 {
+		t.Errorf("Expected 2 visitors in the window, got %+v", c)
+	}
+	vw.advance()
+	if c = vw.count(); c.Estimate != 1 {
+		t.Errorf("Expected 1 visitor in the window, got %+v", c)
+	}
+
+	report := stats{reqTex: &sync.RWMutex{}, resTex: &sync.RWMutex{}, reportFreq: 10}
+	// the same host with a port or in another form is the same visitor
+	for _, host := range []string{"1.1.1.1", "2001:db8::1", "1.1.1.1:8080", "[2001:DB8::1]:443"} {
+		report.addRequest(request{section: "/pages/x", count: 1})
+		report.addVisitor(logEntry{remoteHost: host, request: requestEntry{path: "/pages/x"}})
+	}
+	snap := report.snapshot()
+	snap.windowVisitors, snap.windowSeconds = &visitorCount{Estimate: 5, Error: 1}, 120
+	buf := &bytes.Buffer{}
+	snap.print(buf)
+	if !strings.Contains(buf.String(), "Unique visitors:\n 2 ±1 all\n 2 ±1 /pages\n 5 ±1 last 120s\n") {
+		t.Errorf("Unexpected visitors report %q", buf.String())
+	}
+	js, _ := snap.MarshalJSON()
+	if !strings.Contains(string(js), `"visitors":{"interval":{"estimate":2,"error":1},"window":{"estimate":5,"error":1},"windowSeconds":120,"sections":{"/pages":{"estimate":2,"error":1}}}`) {
+		t.Errorf("Unexpected visitors json %s", js)
+	}
+	buf.Reset()
+	(&csvRenderer{}).renderReport(buf, snap)
+	if !strings.Contains(buf.String(), ",visitors,last 120s,5\n") {
+		t.Errorf("Unexpected visitors csv %q", buf.String())
+	}
+}
+
 func readChan(ctx context.Context, outChan chan string) {
 	for {
 		select {
@@ -184,3 +684,1196 @@ func TestTail(t *testing.T) {
 	<-time.After(time.Millisecond * 100)
 	cancel()
 }
+
+// Live feed
+
+func subCount(f *feed) int {
+	f.tex.Lock()
+	defer f.tex.Unlock()
+	return len(f.subs)
+}
+
+func TestFeed(t *testing.T) {
+	f := newFeed()
+	srv := httptest.NewServer(http.HandlerFunc(f.serveEvents))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?section=/presentations&status=2xx")
+	if err != nil {
+		t.Errorf("Failed to connect - %s", err.Error())
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+
+	// wait for the subscription to register
+	for i := 0; i < 50 && subCount(f) == 0; i++ {
+		<-time.After(time.Millisecond * 10)
+	}
+
+	for i := range logs {
+		e, err := parseLine(logs[i])
+		if err != nil {
+			continue
+		}
+		f.publishEntry(e)
+	}
+	f.publishAlert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 5, Threshold: 5})
+
+	r := bufio.NewReader(resp.Body)
+	entries := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Errorf("Failed to read event - %s", err.Error())
+			t.FailNow()
+		}
+		if strings.HasPrefix(line, "data: ") && !strings.Contains(line, "/presentations") && strings.Contains(line, `"kind":"entry"`) {
+			t.Errorf("Received filtered entry - %s", line)
+		}
+		if line == "event: entry\n" {
+			entries++
+		}
+		if line == "event: alert\n" {
+			break
+		}
+	}
+	if entries != 13 {
+		t.Errorf("Expected 13 entries, got %d", entries)
+	}
+}
+
+func TestFeedSlowClient(t *testing.T) {
+	f := newFeed()
+	s := f.subscribe(eventFilter{})
+	for i := 0; i < subBuffer+1; i++ {
+		f.publishAlert(alertEvent{})
+	}
+	if subCount(f) != 0 {
+		t.Errorf("Failed to drop slow client")
+	}
+	for range s.events {
+	}
+	f.unsubscribe(s)
+}
+
+func TestDashboard(t *testing.T) {
+	f := newFeed()
+	f.publish(event{Kind: "report", Data: stats{reportFreq: 2}})
+	f.publishEntry(logEntry{})
+	f.publishAlert(alertEvent{Triggered: true})
+	if len(f.recent()) != 2 {
+		t.Errorf("Expected entries to be left out of history")
+	}
+
+	w := httptest.NewRecorder()
+	serveDashboard(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "EventSource") {
+		t.Errorf("Failed to serve dashboard")
+	}
+	w = httptest.NewRecorder()
+	serveDashboard(w, httptest.NewRequest("GET", "/nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
+
+// Terminal dashboard
+
+func TestTui(t *testing.T) {
+	ui := newTui(10)
+	for i := 0; i < 5; i++ {
+		ui.hit()
+	}
+	ui.sample()
+	if ui.samples[9] != 5 {
+		t.Errorf("Expected 5 hits in the last sample, got %d", ui.samples[9])
+	}
+
+	report := stats{reqTex: &sync.RWMutex{}, resTex: &sync.RWMutex{}, reportFreq: 2}
+	report.addRequest(request{section: "/pages/one", count: 1})
+	report.addResponse(response{code: 503, count: 1})
+	ui.report(report.snapshot())
+	ui.alert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 1200, Time: time.Now()})
+
+	screen := string(ui.render(60, 20))
+	for _, want := range []string{"/pages", "503", "hits = 1200", "peak 5"} {
+		if !strings.Contains(screen, want) {
+			t.Errorf("Expected screen to contain %q", want)
+		}
+	}
+	if strings.Count(screen, "\r\n") != 19 {
+		t.Errorf("Expected exactly 20 rows")
+	}
+
+	// log data can't smuggle escape sequences onto the screen
+	report.addRequest(request{section: "/\033[2Jx/y", count: 5})
+	ui.report(report.snapshot())
+	ui.alert(alertEvent{Rule: "Path scanning", Metric: "distinct404s", RemoteHost: "203.0.113.9", Path: "/\033]0;pwned\a\u009b", Triggered: true, Time: time.Now()})
+	screen = string(ui.render(200, 20))
+	if strings.Contains(screen, "\033[2J") || strings.Contains(screen, "\033]0") || strings.ContainsAny(screen, "\a\u009b") {
+		t.Errorf("Expected control characters to be replaced, got %q", screen)
+	}
+	if !strings.Contains(screen, "/?[2Jx") || !strings.Contains(screen, "/?]0;pwned??") {
+		t.Errorf("Expected sanitized lines on screen, got %q", screen)
+	}
+
+	// tiny terminals shouldn't panic
+	ui.render(1, 1)
+}
+
+func TestSparkline(t *testing.T) {
+	line, peak := sparkline([]int64{0, 1, 2, 3, 4, 5, 6, 7}, 4)
+	if peak != 7 || len([]rune(line)) != 4 {
+		t.Errorf("Bad sparkline %q (peak %d)", line, peak)
+	}
+	if line, _ := sparkline([]int64{0, 0}, 10); line != "▁▁" {
+		t.Errorf("Bad idle sparkline %q", line)
+	}
+}
+
+// Outputs
+
+// blockSink is a sink that never finishes.
+type blockSink struct{ stuck chan struct{} }
+
+func (b blockSink) report(s stats)     { <-b.stuck }
+func (b blockSink) alert(a alertEvent) { <-b.stuck }
+
+// reopenSink is a blocked sink that records reopens.
+type reopenSink struct {
+	blockSink
+	reopened chan bool
+}
+
+func (r reopenSink) reopen() error { r.reopened <- true; return nil }
+
+func TestOutputs(t *testing.T) {
+	report := stats{reqTex: &sync.RWMutex{}, resTex: &sync.RWMutex{}, reportFreq: 2}
+	report.addRequest(request{section: "/pages/one", count: 1})
+	report.addResponse(response{code: 503, count: 1})
+	report.txBytes = 10
+
+	bufs := map[string]*bytes.Buffer{}
+	f := newFanout()
+	for _, format := range []string{"text", "json", "csv"} {
+		r, err := newRenderer(format)
+		if err != nil {
+			t.Errorf("Failed to create renderer - %s", err.Error())
+			t.FailNow()
+		}
+		bufs[format] = &bytes.Buffer{}
+		f.add(format, newWriterSink(bufs[format], r))
+	}
+	b := blockSink{make(chan struct{})}
+	f.add("blocked", b)
+
+	// the blocked sink must not stall the others
+	f.report(report.snapshot())
+	f.alert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 1200, Time: time.Now()})
+	for i := 0; i < queueSize*2; i++ {
+		f.deliver(func(s sink) {
+			if _, ok := s.(blockSink); ok {
+				s.report(stats{})
+			}
+		})
+	}
+	close(b.stuck)
+	f.close()
+
+	for format, want := range map[string]string{
+		"text": "High traffic generated an alert - hits = 1200",
+		"json": `"kind":"alert"`,
+		"csv":  "alert,High traffic triggered,1200",
+	} {
+		if !strings.Contains(bufs[format].String(), want) {
+			t.Errorf("Expected %s output to contain %q", format, want)
+		}
+		if !strings.Contains(bufs[format].String(), "/pages") {
+			t.Errorf("Expected %s output to contain the report", format)
+		}
+	}
+	if strings.Count(bufs["csv"].String(), "time,kind,key,count") != 1 {
+		t.Errorf("Expected a single csv header")
+	}
+
+	// reopens wait for a full queue rather than being dropped
+	rs := reopenSink{blockSink{make(chan struct{})}, make(chan bool, 1)}
+	g := newFanout()
+	g.add("stuck", rs)
+	for i := 0; i < queueSize+2; i++ {
+		g.report(stats{})
+	}
+	go g.reopen()
+	close(rs.stuck)
+	select {
+	case <-rs.reopened:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected a reopen despite the full queue")
+	}
+	g.close()
+
+	// lossless sinks get every alert, however far behind they are
+	rec := recordSink{make(chan alertEvent)}
+	h := newFanout()
+	h.addLossless("journal", rec)
+	go func() {
+		for i := 0; i < queueSize*2; i++ {
+			h.alert(alertEvent{Rule: "High traffic", Value: float64(i)})
+		}
+	}()
+	for i := 0; i < queueSize*2; i++ {
+		select {
+		case a := <-rec.alerts:
+			if a.Value != float64(i) {
+				t.Errorf("Expected alert %d, got %v", i, a.Value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d alerts, got %d", queueSize*2, i)
+		}
+	}
+	h.close()
+
+	if _, err := newSink("xml"); err == nil {
+		t.Errorf("Failed to fail on unknown format")
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	report := stats{reqTex: &sync.RWMutex{}, resTex: &sync.RWMutex{}, reportFreq: 2}
+	report.addRequest(request{section: "/pages/one", count: 1})
+	report.addResponse(response{code: 503, count: 1})
+	report.addVisitor(logEntry{remoteHost: "1.1.1.1", request: requestEntry{path: "/pages/one"}})
+
+	p := newPromSink()
+	p.report(report.snapshot())
+	snap := report.snapshot()
+	snap.windowVisitors = &visitorCount{Estimate: 5, Error: 1}
+	p.report(snap)
+	p.alert(alertEvent{Rule: "High traffic", Triggered: true})
+	p.alert(alertEvent{Rule: "Path scanning", RemoteHost: "203.0.113.9", Triggered: true})
+	p.alert(alertEvent{Rule: "Path scanning", RemoteHost: "198.51.100.4", Triggered: true})
+	p.alert(alertEvent{Rule: "Path scanning", RemoteHost: "198.51.100.4"})
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`bver_requests_total{section="/pages"} 2`,
+		`bver_responses_total{code="503"} 2`,
+		`bver_alert_firing{rule="High traffic"} 1`,
+		`bver_unique_visitors{scope="interval"} 1`,
+		`bver_unique_visitors{scope="window"} 5`,
+		`bver_unique_visitors_error{scope="window"} 1`,
+		`bver_alert_firing{rule="Path scanning",remote_host="203.0.113.9"} 1`,
+		`bver_alerts_total{rule="Path scanning"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+	if strings.Contains(w.Body.String(), "198.51.100.4") {
+		t.Errorf("Expected recovered clients to be forgotten, got %q", w.Body.String())
+	}
+
+	// sections past -section-top are counted as other, and labels are escaped for prometheus
+	defer func(n int) { sectionTop = n }(sectionTop)
+	sectionTop = 2
+	p = newPromSink()
+	p.report(stats{requests: reqSlice{{section: "/a\"b\\c\n\x01é", count: 3}, {section: "/two", count: 2}, {section: "/three", count: 1}, {section: "/four", count: 1}}})
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		"bver_requests_total{section=\"/a\\\"b\\\\c\\n\x01é\"} 3\n",
+		`bver_requests_total{section="/two"} 2`,
+		`bver_requests_total{section="other"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got %q", want, w.Body.String())
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var bodies []string
+	status := []int{503, 200, 400}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(status[0])
+		status = status[1:]
+	}))
+	defer srv.Close()
+
+	if _, err := newWebhookSink("ftp://example.com"); err == nil {
+		t.Errorf("Failed to fail on a non-http url")
+	}
+	ws, err := newWebhookSink(srv.URL + "/hook?a=b")
+	if err != nil {
+		t.Fatalf("Failed to create webhook - %s", err.Error())
+	}
+	ws.backoff = time.Millisecond
+	start := time.Date(2018, 5, 4, 13, 55, 36, 0, time.UTC)
+	ws.alert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 1500, Op: ">=", Threshold: 1200, Time: start})
+	if len(bodies) != 2 || bodies[0] != bodies[1] {
+		t.Fatalf("Expected the post to be retried after a 503, got %q", bodies)
+	}
+	if !strings.Contains(bodies[0], `"status":"triggered","value":1500,"op":">=","threshold":1200,"triggeredAt":"2018-05-04T13:55:36Z"`) {
+		t.Errorf("Unexpected payload %s", bodies[0])
+	}
+
+	// 4xxs aren't retried, and recoveries say when they triggered
+	ws.alert(alertEvent{Rule: "High traffic", Metric: "hits", Time: start.Add(time.Minute)})
+	if len(bodies) != 3 || !strings.Contains(bodies[2], `"triggeredAt":"2018-05-04T13:55:36Z","recoveredAt":"2018-05-04T13:56:36Z"`) {
+		t.Errorf("Unexpected recovery posts %q", bodies[2:])
+	}
+
+	status = []int{200}
+	ws, err = newWebhookSink("slack=" + srv.URL)
+	if err != nil {
+		t.Fatalf("Failed to create slack webhook - %s", err.Error())
+	}
+	ws.alert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 1500, Time: start})
+	if !strings.HasPrefix(bodies[3], `{"text":"High traffic generated an alert - hits = 1500, triggered at 13:55:36`) {
+		t.Errorf("Unexpected slack body %s", bodies[3])
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	a := alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 1500, Op: ">=", Threshold: 1200, Time: time.Now()}
+	cs := newCommandSink(`echo "$BVER_RULE $BVER_STATUS $BVER_VALUE $BVER_OP $BVER_THRESHOLD" > `+out+`; cat >> `+out, time.Second, 1)
+	if err := cs.run(a); err != nil {
+		t.Fatalf("Failed to run command - %s", err.Error())
+	}
+	b, _ := ioutil.ReadFile(out)
+	lines := strings.SplitN(string(b), "\n", 2)
+	if lines[0] != "High traffic triggered 1500 >= 1200" || !strings.HasPrefix(lines[1], `{"kind":"alert"`) {
+		t.Errorf("Unexpected command output %q", b)
+	}
+
+	if err := newCommandSink("echo oops >&2; exit 3", time.Second, 1).run(a); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("Expected a non-zero exit with its stderr, got %v", err)
+	}
+	if err := newCommandSink("sleep 5", 50*time.Millisecond, 1).run(a); err == nil || !strings.HasPrefix(err.Error(), "Timed out") {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	// the limit holds further alerts until a command finishes
+	cs = newCommandSink("sleep 0.2", time.Second, 1)
+	start := time.Now()
+	cs.alert(a)
+	cs.alert(a)
+	if time.Since(start) < 150*time.Millisecond {
+		t.Errorf("Expected the second alert to wait for the first command")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alerts.jsonl")
+
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatalf("Failed to open journal - %s", err.Error())
+	}
+	start := time.Date(2018, 5, 4, 13, 0, 0, 0, time.UTC)
+	j.alert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 1500, Time: start})
+	j.alert(alertEvent{Rule: "High error rate", Metric: "errorRatio", Triggered: true, Value: 0.2, Time: start.Add(time.Hour)})
+	j.alert(alertEvent{Rule: "High traffic", Metric: "hits", Time: start.Add(2 * time.Hour)})
+	j.alert(alertEvent{Rule: "High traffic on /login", Metric: "hits", Section: "/login", Triggered: true, Value: 700, Time: start.Add(3 * time.Hour)})
+	j.f.WriteString(`{"rule":"torn`)
+	j.f.Close()
+
+	history, err := readJournal(path)
+	if err != nil || len(history) != 4 {
+		t.Fatalf("Expected 4 journaled alerts, got %d (%v)", len(history), err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := listHistory(buf, path, "high traffic", start.Add(time.Minute), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "2018-05-04 High traffic recovered") || !strings.HasPrefix(lines[1], "2018-05-04 High traffic on /login generated") {
+		t.Errorf("Unexpected history %q", lines)
+	}
+
+	// still firing rules are restored without being announced again
+	firing := firingAlerts(history)
+	if len(firing) != 2 {
+		t.Errorf("Expected 2 firing alerts, got %v", firing)
+	}
+	if f := firingAlerts(append(history, alertEvent{Rule: "Path scanning", RemoteHost: "203.0.113.9", Triggered: true})); len(f) != 2 {
+		t.Errorf("Expected security alerts not to be restored, got %v", f)
+	}
+	errs := newErrorMonitor(func(s *satMon) { s.threshold, s.minTotal = 0.1, 0 })
+	hits := newSaturationMonitor()
+	sm := newSectionMonitor(nil)
+	rules{errs, hits, sm}.restore(firing)
+	if errs.state != stateFiring || hits.state != stateInactive || sm.mons["/login"] == nil || sm.mons["/login"].state != stateFiring {
+		t.Errorf("Unexpected restored states %s %s %v", errs.state, hits.state, sm.mons)
+	}
+	errs.started = time.Now().UnixNano()
+	if e := errs.step(time.Now(), 0); e != nil {
+		t.Errorf("Expected a restored rule not to recover during its first window, got %+v", e)
+	}
+	errs.started = time.Now().Add(-errs.ttl).UnixNano()
+	if e := errs.step(time.Now(), 0); e == nil || e.Triggered {
+		t.Errorf("Expected recovery after the first window, got %+v", e)
+	}
+
+	if _, err := parseWhen("2h", start); err != nil {
+		t.Errorf("Failed to parse duration - %s", err.Error())
+	}
+	if when, err := parseWhen("2018-05-04T12:00:00Z", start); err != nil || !when.Equal(start.Add(-time.Hour)) {
+		t.Errorf("Failed to parse time - %v (%v)", when, err)
+	}
+}
+
+func TestSilences(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "High traffic", true},
+		{"High traffic", "High traffic", true},
+		{"High traffic", "High traffic on /login", false},
+		{"High traffic*", "High traffic on /login", true},
+		{"*/login", "High traffic on /login", true},
+		{"High*on*", "High traffic on /login", true},
+		{"*error*", "High traffic", false},
+	} {
+		if got := globMatch(c.pattern, c.s); got != c.want {
+			t.Errorf("globMatch(%q, %q) = %t, expected %t", c.pattern, c.s, got, c.want)
+		}
+	}
+
+	now := time.Now()
+	sr := newSilencer()
+	s, err := parseSilence("rule=High traffic*,for=1h,comment=load test", now)
+	if err != nil {
+		t.Fatalf("Failed to parse silence - %s", err.Error())
+	}
+	if _, err := sr.add(s, "flag"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSilence("rule=x,until=tomorrow", now); err == nil {
+		t.Errorf("Failed to fail on an unknown setting")
+	}
+	if _, err := sr.add(silence{Rule: "x", Start: now}, "flag"); err == nil {
+		t.Errorf("Failed to fail on a silence without an end")
+	}
+
+	if !sr.silenced(alertEvent{Rule: "High traffic on /login", Time: now.Add(time.Minute)}) {
+		t.Errorf("Expected matching alert to be silenced")
+	}
+	if sr.silenced(alertEvent{Rule: "High error rate", Time: now.Add(time.Minute)}) {
+		t.Errorf("Expected other rules not to be silenced")
+	}
+	if len(sr.current(now.Add(2*time.Hour))) != 0 {
+		t.Errorf("Expected the silence to expire")
+	}
+
+	// the http api adds, lists, and deletes silences
+	w := httptest.NewRecorder()
+	sr.ServeHTTP(w, httptest.NewRequest("POST", "/silences", strings.NewReader(`{"rule":"Traffic anomaly","end":"`+now.Add(time.Hour).Format(time.RFC3339)+`"}`)))
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"id":"2"`) {
+		t.Errorf("Failed to add silence - %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	sr.ServeHTTP(w, httptest.NewRequest("GET", "/silences", nil))
+	if !strings.Contains(w.Body.String(), `"rule":"Traffic anomaly"`) {
+		t.Errorf("Expected silence to be listed, got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	sr.ServeHTTP(w, httptest.NewRequest("DELETE", "/silences?id=2", nil))
+	if w.Code != http.StatusNoContent || len(sr.current(now)) != 0 {
+		t.Errorf("Failed to delete silence - %d", w.Code)
+	}
+
+	// notifiers skip silenced alerts
+	rec := recordSink{alerts: make(chan alertEvent, 2)}
+	notifier{rec}.alert(alertEvent{Rule: "High traffic", Silenced: true})
+	notifier{rec}.alert(alertEvent{Rule: "High traffic"})
+	if len(rec.alerts) != 1 || (<-rec.alerts).Silenced {
+		t.Errorf("Expected only the unsilenced alert to be notified")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bver")
+	if err != nil {
+		t.Errorf("Failed to create temp dir - %s", err.Error())
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.csv")
+
+	f, err := openRotatingFile(path, 100, 0, 2, true)
+	if err != nil {
+		t.Errorf("Failed to open - %s", err.Error())
+		t.FailNow()
+	}
+	defer f.Close()
+	ws := newWriterSink(f, &csvRenderer{})
+	ws.restart(f)
+
+	for i := 0; i < 5; i++ {
+		ws.alert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 1200, Time: time.Now()})
+		ws.alert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: false, Value: 10, Time: time.Now()})
+		ws.alert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 1200, Time: time.Now()})
+	}
+
+	rotated, err := f.rotated()
+	if err != nil || len(rotated) != 2 {
+		t.Errorf("Expected 2 rotated files to be kept, got %v (%v)", rotated, err)
+	}
+	for i := range rotated {
+		if !strings.HasSuffix(rotated[i], ".gz") {
+			t.Errorf("Expected %s to be compressed", rotated[i])
+		}
+	}
+	b, _ := ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(b), "time,kind,key,count\n") {
+		t.Errorf("Expected a header in the new file, got %q", string(b))
+	}
+
+	// an external rotation followed by a reopen starts a new file
+	os.Rename(path, path+".old")
+	if err := ws.reopen(); err != nil {
+		t.Errorf("Failed to reopen - %s", err.Error())
+	}
+	ws.alert(alertEvent{Rule: "High traffic", Metric: "hits", Triggered: true, Value: 1200, Time: time.Now()})
+	b, _ = ioutil.ReadFile(path)
+	if strings.Count(string(b), "\n") != 2 {
+		t.Errorf("Expected a header and a row after reopening, got %q", string(b))
+	}
+}
+
+func TestClients(t *testing.T) {
+	for host, want := range map[string]string{
+		"10.0.0.1":          "10.0.0.1",
+		"10.0.0.1:8080":     "10.0.0.1",
+		"::ffff:10.0.0.1":   "10.0.0.1",
+		"2001:DB8::1":       "2001:db8::1",
+		"[2001:db8::1]:443": "2001:db8::1",
+		"fe80::1%eth0":      "fe80::1",
+		"Crawler.Example":   "crawler.example",
+	} {
+		if got := clientHost(host); got != want {
+			t.Errorf("Expected %q to parse as %q, got %q", host, want, got)
+		}
+	}
+	clientPrefix = true
+	for host, want := range map[string]string{
+		"203.0.113.77":          "203.0.113.0/24",
+		"2001:db8:4:1:abcd::99": "2001:db8:4:1::/64",
+		"crawler.example":       "crawler.example",
+	} {
+		if got := clientKey(host); got != want {
+			t.Errorf("Expected %q to aggregate to %q, got %q", host, want, got)
+		}
+	}
+	clientPrefix = false
+
+	// a heavy client survives a flood of one-off clients
+	tt := newTalkerTable()
+	for i := 0; i < 5000; i++ {
+		tt.add(fmt.Sprintf("10.1.%d.%d", i/256, i%256), 10)
+		if i%2 == 0 {
+			tt.add("10.0.0.1", 1000)
+		}
+	}
+	if len(tt.counts) > talkerCapacity {
+		t.Errorf("Expected at most %d clients tracked, got %d", talkerCapacity, len(tt.counts))
+	}
+	if top := tt.top(1, "bytes"); len(top) != 1 || top[0].Client != "10.0.0.1" || top[0].Hits < 2500 {
+		t.Errorf("Expected 10.0.0.1 to be the top client, got %+v", top)
+	}
+
+	// a new client replaces the one with the fewest hits, inheriting its counts
+	tt = newTalkerTable()
+	tt.capacity = 2
+	for _, client := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3", "10.0.0.3"} {
+		tt.add(client, 10)
+	}
+	if top := tt.top(2, "hits"); len(top) != 2 || top[0] != (clientCount{"10.0.0.3", 3, 30}) || top[1] != (clientCount{"10.0.0.1", 2, 20}) {
+		t.Errorf("Expected 10.0.0.3 to replace 10.0.0.2, got %+v", top)
+	}
+
+	// high traffic alerts name the top contributors
+	contributors = newClientWindow(20, 10)
+	topClients = 5
+	defer func() { contributors, topClients = nil, 0 }()
+	for i := 0; i < 3; i++ {
+		contributors.add(logEntry{remoteHost: "10.0.0.1", txBytes: 100})
+	}
+	contributors.add(logEntry{remoteHost: "10.0.0.2", txBytes: 900})
+	e := newSaturationMonitor().event(true, 4)
+	if msg := e.message(); !strings.Contains(msg, "top clients 10.0.0.1 (3), 10.0.0.2 (1)") {
+		t.Errorf("Expected the top clients in the alert, got %q", msg)
+	}
+	if e = newLowTrafficMonitor().event(true, 4); len(e.Top) != 0 {
+		t.Errorf("Expected no top clients for low traffic, got %+v", e.Top)
+	}
+	contributors.advance()
+	contributors.advance()
+	if top := contributors.top(5, "hits"); len(top) != 0 {
+		t.Errorf("Expected the window to forget old clients, got %+v", top)
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	var err error
+	if trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.0.2.7,2001:db8::/32"); err != nil {
+		t.Fatalf("Failed to parse trusted proxies - %s", err.Error())
+	}
+	defer func() { trustedProxies = nil }()
+	if _, err := parseTrustedProxies("10.0.0.0/8,lb"); err == nil {
+		t.Errorf("Failed to fail on an invalid proxy")
+	}
+
+	for _, c := range []struct{ remote, forwarded, want string }{
+		{"10.0.0.2", "203.0.113.9", "203.0.113.9"},
+		{"10.0.0.2", "6.6.6.6, 203.0.113.9, 10.0.0.1", "203.0.113.9"},        // forged hops left of the client are ignored
+		{"198.51.100.1", "203.0.113.9", "198.51.100.1"},                      // untrusted peers can't forward
+		{"192.0.2.7", "10.0.0.3, 10.0.0.1", "10.0.0.3"},                      // all proxies, the leftmost is closest
+		{"10.0.0.2", "unknown, 10.0.0.1", "10.0.0.1"},                        // unparseable hops stop at the proxy
+		{"[2001:db8::5]:443", "[2001:db8:ffff::1]:5000", "2001:db8:ffff::1"}, // in a trusted network
+		{"2001:db8::5", "2a00:1450::1", "2a00:1450::1"},
+		{"10.0.0.2", "-", "10.0.0.2"},
+	} {
+		if got := resolveClient(c.remote, c.forwarded); got != c.want {
+			t.Errorf("Expected %s forwarding %q to resolve to %s, got %s", c.remote, c.forwarded, c.want, got)
+		}
+	}
+
+	if got := quotedFields(`"-" "curl/8.0 \"x\"" "1.2.3.4" 0.010`); len(got) != 3 || got[1] != `curl/8.0 "x"` || got[2] != "1.2.3.4" {
+		t.Errorf("Failed to parse quoted fields, got %q", got)
+	}
+
+	forwardedField, latencyUnit = 3, "s"
+	defer func() { forwardedField, latencyUnit = 0, "" }()
+	e, err := parseLine(`10.0.0.2 - - [10/Oct/2000:13:55:36 -0700] "GET /a HTTP/1.1" 200 10 "-" "curl/8.0" "203.0.113.9, 10.0.0.1" 0.250`)
+	if err != nil {
+		t.Fatalf("Failed to parse line - %s", err.Error())
+	}
+	if e.remoteHost != "203.0.113.9" || !e.timed || e.duration != 250*time.Millisecond {
+		t.Errorf("Expected the forwarded client and duration, got %+v", e)
+	}
+}
+
+// testPointer is a data section pointer in a test MaxMind DB.
+type testPointer int
+
+// testMMDB builds a MaxMind DB with 24 bit records, mapping each network to its record in data
+// (records may point into earlier records with testPointer).
+func testMMDB(ipVersion int, networks map[string]map[string]interface{}) []byte {
+	var enc func(v interface{}) []byte
+	enc = func(v interface{}) []byte {
+		switch v := v.(type) {
+		case string:
+			if len(v) >= 29 {
+				return append([]byte{2<<5 | 29, byte(len(v) - 29)}, v...)
+			}
+			return append([]byte{2<<5 | byte(len(v))}, v...)
+		case int:
+			return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+		case testPointer:
+			return []byte{1<<5 | byte(v>>8&7), byte(v)}
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			out := []byte{7<<5 | byte(len(v))}
+			for _, k := range keys {
+				out = append(append(out, enc(k)...), enc(v[k])...)
+			}
+			return out
+		}
+		panic(fmt.Sprintf("can't encode %T", v))
+	}
+
+	// the tree's nodes, as pairs of records: >= 0 is a node, -1 is empty, < -1 is data offset -2-r
+	nodes := [][2]int{{-1, -1}}
+	var data []byte
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	for _, cidr := range cidrs {
+		_, n, _ := net.ParseCIDR(cidr)
+		ones, _ := n.Mask.Size()
+		ip := n.IP.To16()
+		if ipVersion == 4 {
+			ip = n.IP.To4()
+		} else if n.IP.To4() != nil {
+			// ipv4 lives at ::/96 in an ipv6 tree
+			ip, ones = append(make(net.IP, 12), n.IP.To4()...), ones+96
+		}
+		leaf := -2 - len(data)
+		data = append(data, enc(networks[cidr])...)
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = leaf
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var buf []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := len(nodes)
+			if r >= 0 {
+				v = r
+			} else if r < -1 {
+				v = len(nodes) + 16 + (-2 - r)
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMarker...)
+	return append(buf, enc(map[string]interface{}{
+		"node_count":    len(nodes),
+		"record_size":   24,
+		"ip_version":    ipVersion,
+		"database_type": "Test",
+	})...)
+}
+
+func TestGeo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	country, asn := filepath.Join(dir, "country.mmdb"), filepath.Join(dir, "asn.mmdb")
+	ioutil.WriteFile(country, testMMDB(6, map[string]map[string]interface{}{
+		"203.0.113.0/24": {"country": map[string]interface{}{"iso_code": "FR"}},
+		// networks are written in order, so the country map is after this record (22 bytes) and
+		// the start of the next (9 bytes)
+		"2001:db8::/32": {"registered_country": testPointer(31)},
+	}), 0644)
+	ioutil.WriteFile(asn, testMMDB(4, map[string]map[string]interface{}{
+		"203.0.113.0/25": {"autonomous_system_number": 64500, "autonomous_system_organization": "Example Net"},
+	}), 0644)
+	if _, err := newGeoIP(filepath.Join(dir, "missing.mmdb")); err == nil {
+		t.Errorf("Failed to fail on a missing database")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "bad.mmdb"), []byte("not a database"), 0644)
+	if _, err := newGeoIP(filepath.Join(dir, "bad.mmdb")); err == nil {
+		t.Errorf("Failed to fail on a bad database")
+	}
+
+	g, err := newGeoIP(country, "", asn)
+	if err != nil {
+		t.Fatalf("Failed to open databases - %s", err.Error())
+	}
+	for host, want := range map[string]geoInfo{
+		"203.0.113.9":      {country: "FR", asn: 64500, asOrg: "Example Net"},
+		"203.0.113.200":    {country: "FR"},
+		"[2001:db8::1]:80": {country: "FR"},
+		"198.51.100.1":     {},
+		"2a00::1":          {},
+		"crawler.example":  {},
+	} {
+		e := logEntry{remoteHost: host}
+		g.enrich(&e)
+		if got := (geoInfo{e.country, e.asn, e.asOrg}); got != want {
+			t.Errorf("Expected %s to be %+v, got %+v", host, want, got)
+		}
+	}
+
+	// reports count countries and networks, and rules can be scoped to a country
+	report := stats{reqTex: &sync.RWMutex{}, resTex: &sync.RWMutex{}, reportFreq: 10}
+	r, err := parseRule("name=French traffic,country=fr,threshold=1")
+	if err != nil {
+		t.Fatalf("Failed to parse rule - %s", err.Error())
+	}
+	for _, host := range []string{"203.0.113.9", "203.0.113.10", "2001:db8::1", "198.51.100.1"} {
+		e := logEntry{remoteHost: host, request: requestEntry{path: "/"}}
+		g.enrich(&e)
+		report.addRequest(request{section: "/", count: 1})
+		report.addGeo(e)
+		r.observe(e)
+	}
+	if v := r.value(); v != 3 {
+		t.Errorf("Expected the country rule to count 3 requests, got %v", v)
+	}
+	buf := &bytes.Buffer{}
+	report.snapshot().print(buf)
+	if out := buf.String(); !strings.Contains(out, "Countries:\n  3 FR\n") || !strings.Contains(out, "Networks:\n  2 AS64500 Example Net\n") {
+		t.Errorf("Expected countries and networks in the report, got %q", out)
+	}
+}
+
+func TestMMDBFuzz(t *testing.T) {
+	// cyclic data fails rather than recursing forever
+	db, err := newMMDB(testMMDB(4, map[string]map[string]interface{}{
+		"203.0.113.0/24": {"a": testPointer(0), "b": testPointer(0)},
+	}))
+	if err != nil {
+		t.Fatalf("Failed to open database - %s", err.Error())
+	}
+	if _, err := db.lookup(net.ParseIP("203.0.113.9")); err == nil {
+		t.Errorf("Expected cyclic data to fail")
+	}
+
+	// truncated and corrupted files fail or decode, but never panic
+	valid := testMMDB(6, map[string]map[string]interface{}{
+		"203.0.113.0/24": {"country": map[string]interface{}{"iso_code": "FR"}},
+		"2001:db8::/32":  {"registered_country": testPointer(31)},
+	})
+	lookup := func(buf []byte) {
+		db, err := newMMDB(buf)
+		if err != nil {
+			return
+		}
+		for _, ip := range []string{"203.0.113.9", "2001:db8::1", "198.51.100.1", "::1"} {
+			db.lookup(net.ParseIP(ip))
+		}
+	}
+	for i := range valid {
+		lookup(valid[:i])
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		buf := append([]byte{}, valid...)
+		for n := rnd.Intn(4); n >= 0; n-- {
+			buf[rnd.Intn(len(buf))] = byte(rnd.Intn(256))
+		}
+		lookup(buf)
+	}
+}
+
+func TestUserAgents(t *testing.T) {
+	for ua, want := range map[string]string{
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_9_1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/32.0.1700.77 Safari/537.36":                 "browser Chrome",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 Edg/120.0":                   "browser Edge",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                                  "browser Firefox",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1": "mobile Safari",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36":                       "mobile Chrome",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                                                "crawler Googlebot",
+		"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)":                                                                 "crawler Bingbot",
+		"Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)":                                                                      "bot AhrefsBot",
+		"SomeNewCrawler/1.0 (+https://example.com/crawler)":                                                                                       "bot other",
+		"curl/7.58.0":                  "library curl",
+		"python-requests/2.31.0":       "library python-requests",
+		"Go-http-client/1.1":           "library Go",
+		"-":                            "unknown empty",
+		"TotallyUnheardOf/0.1 (Plan9)": "unknown other",
+	} {
+		if got := agents.classify(ua).String(); got != want {
+			t.Errorf("Expected %q to be %q, got %q", ua, want, got)
+		}
+	}
+
+	// the fixtures are combined format, with a desktop browser
+	e, err := parseLine(logs[len(logs)-1])
+	if err != nil || e.agentName() != "browser Chrome" || e.bot() {
+		t.Errorf("Expected the fixture's user agent to be a browser, got %+v", e)
+	}
+
+	// rules and feed filters can leave out bots
+	r, err := parseRule("name=Humans,bots=false,threshold=10")
+	if err != nil {
+		t.Fatalf("Failed to parse rule - %s", err.Error())
+	}
+	bot, _ := parseLine(logLine + ` "-" "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"`)
+	r.observe(e)
+	r.observe(bot)
+	if v := r.value(); v != 1 {
+		t.Errorf("Expected the rule to ignore the crawler, got %v", v)
+	}
+	req := httptest.NewRequest("GET", "/events?bots=false", nil)
+	ef := parseFilter(req)
+	if ef.match(event{Kind: "entry", entry: &bot}) || !ef.match(event{Kind: "entry", entry: &e}) {
+		t.Errorf("Expected the feed filter to drop only the crawler")
+	}
+
+	report := stats{reqTex: &sync.RWMutex{}, resTex: &sync.RWMutex{}, reportFreq: 10}
+	for _, entry := range []logEntry{e, e, bot} {
+		report.addRequest(request{section: "/", count: 1})
+		report.addAgent(entry)
+	}
+	buf := &bytes.Buffer{}
+	report.snapshot().print(buf)
+	if !strings.Contains(buf.String(), "User agents:\n  2 browser Chrome\n  1 crawler Googlebot\n") {
+		t.Errorf("Expected user agents in the report, got %q", buf.String())
+	}
+
+	// rule files replace the built in rules
+	dir, err := ioutil.TempDir("", "bver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agents")
+	ioutil.WriteFile(path, []byte("# ours\nbot Internal-Probe ^probe/\n"), 0644)
+	uc := mustUAClassifier(defaultUARules)
+	if err := uc.load(path); err != nil {
+		t.Fatalf("Failed to load rules - %s", err.Error())
+	}
+	if got := uc.classify("probe/1.0").String(); got != "bot Internal-Probe" {
+		t.Errorf("Expected the loaded rule to match, got %q", got)
+	}
+	for _, bad := range []string{"robot R2D2 beep", "bot Short", "bot Bad (unclosed"} {
+		if _, err := parseUARules(bad); err == nil {
+			t.Errorf("Failed to fail on rule %q", bad)
+		}
+	}
+}
+
+func TestReferers(t *testing.T) {
+	for ref, want := range map[string]string{
+		"https://News.Example.com:443/item?id=1": "news.example.com",
+		"-":                                      "",
+		"":                                       "",
+	} {
+		if got := refererHost(ref); got != want {
+			t.Errorf("Expected %q to have host %q, got %q", ref, want, got)
+		}
+	}
+	if !isAsset("/img/logo.PNG?v=2") || isAsset("/blog/post") {
+		t.Errorf("Failed to tell static assets from pages")
+	}
+
+	defer func() { siteHosts = nil }()
+	count := func() stats {
+		report := stats{reqTex: &sync.RWMutex{}, resTex: &sync.RWMutex{}, reportFreq: 10}
+		for i := range logs {
+			e, err := parseLine(logs[i])
+			if err != nil {
+				continue
+			}
+			report.addRequest(refererRequest(e))
+			report.addReferer(e)
+		}
+		return report.snapshot()
+	}
+
+	// the fixtures' images are linked from semicomplete.com, another site
+	siteHosts = []string{"example.org"}
+	snap := count()
+	buf := &bytes.Buffer{}
+	snap.print(buf)
+	out := buf.String()
+	if !strings.Contains(out, "13 /presentations (possible hotlinking, 13 of 13 assets linked from other sites)") {
+		t.Errorf("Expected /presentations to be flagged as hotlinked, got %q", out)
+	}
+	if !strings.Contains(out, "Referers (0 same-site, 13 external):\n 13 semicomplete.com\n") {
+		t.Errorf("Expected the external referers, got %q", out)
+	}
+
+	// unless it's this site
+	siteHosts = []string{"example.org", "semicomplete.com"}
+	snap = count()
+	if snap.requests[0].hotlinked() || snap.sameSite != 13 || len(snap.topReferers) != 0 {
+		t.Errorf("Expected same-site referers, got %+v", snap)
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	defer func() { scanLimit, bruteLimit, injection = 0, 0, false }()
+	scanLimit, bruteLimit, injection = 20, 10, true
+	m := newSecurityMonitor(func(m *secMon) {
+		m.window = time.Minute
+		m.detectors = []*detector{m.detectors[0], m.detectors[1]}
+	})
+	if len(m.detectors) != 2 || m.detectors[0].name != "Path scanning" || m.detectors[1].name != "Credential stuffing" {
+		t.Fatalf("Expected the scan and brute force detectors, got %+v", m.detectors)
+	}
+	now := time.Now()
+	hit := func(host, path string, code int) {
+		m.add(now, logEntry{remoteHost: host, request: requestEntry{path: path}, respCode: code})
+	}
+
+	// the same missing path repeatedly isn't a scan, but many distinct ones are
+	for i := 0; i < scanLimit; i++ {
+		hit("198.51.100.4", "/favicon.ico", 404)
+		hit("203.0.113.9", fmt.Sprintf("/backup-%d.zip", i), 404)
+	}
+	for i := 0; i < bruteLimit; i++ {
+		hit("[2001:db8::1]:443", "/wp-login.php?redirect_to=x", 401)
+		hit("198.51.100.4", "/private", 403)
+	}
+	events := m.step(now)
+	if len(events) != 2 {
+		t.Fatalf("Expected a scanning and a credential stuffing alert, got %+v", events)
+	}
+	if e := events[0]; e.Rule != "Path scanning" || e.RemoteHost != "203.0.113.9" || e.Value != float64(scanLimit) || !e.Triggered {
+		t.Errorf("Expected a path scanning alert naming the client, got %+v", e)
+	}
+	if msg := events[0].message(); !strings.HasPrefix(msg, "Path scanning from 203.0.113.9 generated an alert - distinct404s = 20") || !strings.HasSuffix(msg, "last /backup-19.zip") {
+		t.Errorf("Expected the alert message to name the client and path, got %q", msg)
+	}
+	if e := events[1]; e.Rule != "Credential stuffing" || e.RemoteHost != "2001:db8::1" {
+		t.Errorf("Expected a credential stuffing alert naming the client, got %+v", e)
+	}
+	if events = m.step(now.Add(time.Second)); len(events) != 0 {
+		t.Errorf("Expected firing alerts not to repeat, got %+v", events)
+	}
+
+	// once the window passes, both recover and are forgotten
+	events = m.step(now.Add(time.Minute))
+	if len(events) != 2 || events[0].Triggered || events[1].Triggered || events[0].message() != "Path scanning from 203.0.113.9 recovered at "+now.Add(time.Minute).Format("15:04:05.1234") {
+		t.Errorf("Expected both alerts to recover, got %+v", events)
+	}
+	for _, d := range m.detectors {
+		if len(d.clients) != 0 {
+			t.Errorf("Expected %s to forget quiet clients, got %+v", d.name, d.clients)
+		}
+	}
+
+	// signatures, plain and encoded
+	for path, rule := range map[string]string{
+		"/item?id=1%27%20OR%20%271%27=%271":                   "SQL injection",
+		"/search?q=1+UNION+ALL+SELECT+password+FROM+users":    "SQL injection",
+		"/search?q=%253Cscript%253Ealert(1)%253C/script%253E": "Cross-site scripting",
+		"/static/..%2f..%2f..%2fetc/passwd":                   "Path traversal",
+		"/blog/union-station-or-select-cafes":                 "",
+		"/shop?sort=price&order=asc":                          "",
+	} {
+		m = newSecurityMonitor(func(m *secMon) { m.detectors = m.detectors[len(m.detectors)-3:] })
+		m.add(now, logEntry{remoteHost: "192.0.2.1", request: requestEntry{path: path}, respCode: 200})
+		events := m.step(now)
+		if rule == "" && len(events) != 0 {
+			t.Errorf("Expected %q not to match a signature, got %+v", path, events)
+		}
+		if rule != "" && (len(events) != 1 || events[0].Rule != rule || events[0].Path != path) {
+			t.Errorf("Expected %q to match %s, got %+v", path, rule, events)
+		}
+	}
+}
+
+func TestBanList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { trustedProxies, banTop = nil, 0 }()
+	trustedProxies, _ = parseTrustedProxies("10.0.0.0/8")
+	banTop = 1
+
+	lists := map[string]*banList{}
+	for _, format := range []string{"plain", "nginx", "ipset"} {
+		b, err := newBanList(format + ":" + filepath.Join(dir, format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lists[format] = b
+	}
+	if _, err := newBanList("iptables:" + filepath.Join(dir, "rules")); err == nil {
+		t.Errorf("Expected an unknown format to fail")
+	}
+	read := func(format string) string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if read("plain") != "" {
+		t.Errorf("Expected a new ban list to be empty, got %q", read("plain"))
+	}
+
+	now := time.Now()
+	for _, a := range []alertEvent{
+		{Rule: "Path scanning", RemoteHost: "203.0.113.9", Triggered: true, Time: now},
+		{Rule: "SQL injection", RemoteHost: "2001:DB8::1", Triggered: true, Time: now.Add(30 * time.Minute)},
+		{Rule: "Path scanning", RemoteHost: "10.1.2.3", Triggered: true, Time: now},
+		{Rule: "Path scanning", RemoteHost: "198.51.100.4", Time: now},
+		{Rule: "High traffic", Top: []clientCount{{Client: "192.0.2.0/24"}, {Client: "192.0.2.77"}}, Triggered: true, Time: now},
+	} {
+		for _, b := range lists {
+			b.alert(a)
+		}
+	}
+	if got := read("plain"); got != "192.0.2.0/24\n2001:db8::1\n203.0.113.9\n" {
+		t.Errorf("Expected flagged clients, but not trusted proxies or recoveries, got %q", got)
+	}
+	if got := read("nginx"); got != "deny 192.0.2.0/24;\ndeny 2001:db8::1;\ndeny 203.0.113.9;\n" {
+		t.Errorf("Expected nginx deny directives, got %q", got)
+	}
+	if got := read("ipset"); got != "create bver-ban hash:net family inet -exist\nflush bver-ban\n"+
+		"create bver-ban6 hash:net family inet6 -exist\nflush bver-ban6\n"+
+		"add bver-ban 192.0.2.0/24 -exist\nadd bver-ban6 2001:db8::1 -exist\nadd bver-ban 203.0.113.9 -exist\n" {
+		t.Errorf("Expected ipset restore input, got %q", got)
+	}
+
+	// restarts keep the bans, read back from the file
+	for _, format := range []string{"plain", "nginx", "ipset"} {
+		before := read(format)
+		b, err := newBanList(format + ":" + filepath.Join(dir, format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b.bans) != 3 || read(format) != before {
+			t.Errorf("Expected the %s bans to be restored, got %v", format, b.bans)
+		}
+	}
+
+	// or from the journal, expiring as they would have
+	journalPath = filepath.Join(dir, "journal")
+	defer func() { journalPath = "" }()
+	j, err := openJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.alert(alertEvent{Rule: "Path scanning", RemoteHost: "203.0.113.9", Triggered: true, Time: now.Add(-banTTL)})
+	j.alert(alertEvent{Rule: "SQL injection", RemoteHost: "198.51.100.4", Triggered: true, Time: now.Add(-time.Minute)})
+	j.alert(alertEvent{Rule: "SQL injection", RemoteHost: "192.0.2.1", Triggered: true, Silenced: true, Time: now})
+	j.f.Close()
+	b, err := newBanList("plain:" + filepath.Join(dir, "restored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.bans) != 2 || !b.bans["198.51.100.4"].Equal(now.Add(banTTL-time.Minute)) || !b.bans["192.0.2.1"].Equal(now.Add(banTTL)) {
+		t.Errorf("Expected the unexpired journaled bans, silenced or not, to be restored, got %v", b.bans)
+	}
+	os.Remove(journalPath)
+	os.Remove(filepath.Join(dir, "restored"))
+
+	// bans last while their alert fires, and expire a ttl after it recovered
+	p := lists["plain"]
+	p.expire(now.Add(2 * banTTL))
+	if got := read("plain"); got != "192.0.2.0/24\n2001:db8::1\n203.0.113.9\n" {
+		t.Errorf("Expected bans to last while their alerts fire, got %q", got)
+	}
+	p.alert(alertEvent{Rule: "Path scanning", RemoteHost: "203.0.113.9", Time: now.Add(2 * banTTL)})
+	p.alert(alertEvent{Rule: "High traffic", Time: now.Add(2 * banTTL)})
+	p.expire(now.Add(3*banTTL - time.Second))
+	if got := read("plain"); got != "192.0.2.0/24\n2001:db8::1\n203.0.113.9\n" {
+		t.Errorf("Expected bans to last a ttl after their alerts recovered, got %q", got)
+	}
+	p.expire(now.Add(3 * banTTL))
+	if got := read("plain"); got != "2001:db8::1\n" {
+		t.Errorf("Expected expired bans to be lifted, got %q", got)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("Expected no temporary files to be left behind, got %d files", len(files))
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+type (
+	// mmdb is a MaxMind DB file (GeoLite2, GeoIP2, DB-IP, ...) loaded into memory. It's a binary
+	// search tree over the bits of an address, whose leaves point into a data section of typed
+	// values. See https://maxmind.github.io/MaxMind-DB/.
+	mmdb struct {
+		buf        []byte // buf is the whole file.
+		nodeCount  uint   // nodeCount is how many nodes the search tree has.
+		recordSize uint   // recordSize is how many bits each of a node's two records has: 24, 28, or 32.
+		ipVersion  uint   // ipVersion is 4 if the tree only holds IPv4 addresses, else 6.
+		dbType     string // dbType is the database's type, e.g. "GeoLite2-Country".
+		treeSize   uint   // treeSize is how many bytes the search tree has.
+		v4Start    uint   // v4Start is the node IPv4 addresses start from in an IPv6 tree (::/96).
+	}
+)
+
+const (
+	// mmdbMaxDepth is how deeply maps, arrays, and pointers may nest in a value, so a bad file can't
+	// exhaust the stack.
+	mmdbMaxDepth = 64
+	// mmdbMaxPointers is how many pointers decoding a value may follow, so a bad file can't make one
+	// lookup expand without bound.
+	mmdbMaxPointers = 4096
+)
+
+// mmdbMarker starts the metadata at the end of a MaxMind DB file.
+var mmdbMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// openMMDB reads and checks the MaxMind DB file at path.
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDB(buf)
+}
+
+// newMMDB returns a pointer to an mmdb reading from buf.
+func newMMDB(buf []byte) (*mmdb, error) {
+	i := bytes.LastIndex(buf, mmdbMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("Not a MaxMind DB file")
+	}
+	meta := &mmdb{buf: buf[i+len(mmdbMarker):]}
+	v, _, err := meta.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Bad metadata - %s", err.Error())
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Bad metadata")
+	}
+	db := &mmdb{
+		buf:        buf,
+		nodeCount:  uint(toUint(m["node_count"])),
+		recordSize: uint(toUint(m["record_size"])),
+		ipVersion:  uint(toUint(m["ip_version"])),
+	}
+	db.dbType, _ = m["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("Unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("Unsupported ip version %d", db.ipVersion)
+	}
+	db.treeSize = db.nodeCount * db.recordSize / 4
+	if db.treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("Search tree is larger than the file")
+	}
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.v4Start < db.nodeCount; n++ {
+			db.v4Start = db.record(db.v4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns a node's left (bit 0) or right (bit 1) record.
+func (db *mmdb) record(node uint, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// lookup returns the data for ip, or nil if the database doesn't have it.
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	offset, ok, err := db.find(ip)
+	if !ok || err != nil {
+		return nil, err
+	}
+	v, _, err := db.decode(offset, db.treeSize+16)
+	return v, err
+}
+
+// find returns the absolute offset of ip's data, and whether the database has it.
+func (db *mmdb) find(ip net.IP) (uint, bool, error) {
+	node, bits := uint(0), ip.To16()
+	if v4 := ip.To4(); v4 != nil {
+		node, bits = db.v4Start, v4
+	} else if db.ipVersion == 4 || bits == nil {
+		return 0, false, nil
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-uint(i%8))&1))
+	}
+	if node == db.nodeCount {
+		return 0, false, nil
+	}
+	if node < db.nodeCount {
+		return 0, false, fmt.Errorf("Search tree is too deep")
+	}
+	offset := node - db.nodeCount + db.treeSize
+	if offset >= uint(len(db.buf)) {
+		return 0, false, fmt.Errorf("Bad data pointer")
+	}
+	return offset, true, nil
+}
+
+// decode decodes the value at offset, where pointers are relative to base. It returns the value and
+// the offset after it. Maps become map[string]interface{}, arrays []interface{}, and numbers
+// uint64, int64, or float64.
+func (db *mmdb) decode(offset, base uint) (interface{}, uint, error) {
+	pointers := 0
+	return db.decodeAt(offset, base, 0, &pointers)
+}
+
+// decodeAt decodes the value at offset, nested depth deep. pointers counts the pointers followed so far.
+func (db *mmdb) decodeAt(offset, base uint, depth int, pointers *int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("Data is nested too deeply")
+	}
+	next := func(n uint) ([]byte, error) {
+		if offset+n > uint(len(db.buf)) {
+			return nil, fmt.Errorf("Unexpected end of data")
+		}
+		b := db.buf[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	kind := uint(ctrl >> 5)
+	if kind == 1 {
+		// pointer, whose size bits are part of the address
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		b, err := next(ss + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var p uint
+		switch ss {
+		case 0:
+			p = vvv<<8 | uint(b[0])
+		case 1:
+			p = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			p = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(b))
+		}
+		if base+p >= uint(len(db.buf)) || db.buf[base+p]>>5 == 1 {
+			// pointers can't point to pointers
+			return nil, 0, fmt.Errorf("Bad pointer")
+		}
+		if *pointers++; *pointers > mmdbMaxPointers {
+			return nil, 0, fmt.Errorf("Too many pointers")
+		}
+		v, _, err := db.decodeAt(base+p, base, depth+1, pointers)
+		return v, offset, err
+	}
+	if kind == 0 {
+		b, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(b[0])
+	}
+	size := uint(ctrl & 0x1F)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch size {
+		case 29:
+			size = 29 + uint(b[0])
+		case 30:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+	switch kind {
+	case 2, 4: // string, bytes
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind == 2 {
+			return string(b), offset, nil
+		}
+		return append([]byte{}, b...), offset, nil
+	case 3, 15: // double, float
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind == 3 && size == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+		}
+		if kind == 15 && size == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+		}
+		return nil, 0, fmt.Errorf("Bad float size %d", size)
+	case 5, 6, 8, 9, 10: // uint16, uint32, int32, uint64, uint128 (truncated to 64 bits)
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		if kind == 8 {
+			return int64(int32(u)), offset, nil
+		}
+		return u, offset, nil
+	case 7: // map
+		m := map[string]interface{}{}
+		for i := uint(0); i < size; i++ {
+			k, o, err := db.decodeAt(offset, base, depth+1, pointers)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("Map key isn't a string")
+			}
+			v, o, err := db.decodeAt(o, base, depth+1, pointers)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], offset = v, o
+		}
+		return m, offset, nil
+	case 11: // array
+		var a []interface{}
+		for i := uint(0); i < size; i++ {
+			v, o, err := db.decodeAt(offset, base, depth+1, pointers)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), o
+		}
+		return a, offset, nil
+	case 14: // boolean, whose value is its size
+		return size != 0, offset, nil
+	}
+	return nil, 0, fmt.Errorf("Unsupported data type %d", kind)
+}
+
+// toUint returns v as a uint64, or 0 if it isn't an unsigned number.
+func toUint(v interface{}) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
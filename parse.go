@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type (
@@ -16,13 +19,21 @@ type (
 
 	// logEntry defines a common logfile formatted log entry.
 	logEntry struct {
-		remoteHost string       // remoteHost is the host that made the request.
-		userId     string       // userId is the user-identifier field.
-		authUser   string       // authuser is the user that made the request.
-		date       string       // date is the date of the request.
-		request    requestEntry // request is the "request" field.
-		respCode   int          // respCode is the status the server responded with.
-		txBytes    int          // txBytes is a count of the bytes the server responded with.
+		remoteHost string        // remoteHost is the host that made the request.
+		userId     string        // userId is the user-identifier field.
+		authUser   string        // authuser is the user that made the request.
+		date       string        // date is the date of the request.
+		request    requestEntry  // request is the "request" field.
+		respCode   int           // respCode is the status the server responded with.
+		txBytes    int           // txBytes is a count of the bytes the server responded with.
+		duration   time.Duration // duration is how long the request took, if timed.
+		timed      bool          // timed is whether the line's last field held the request duration (see -latency).
+		country    string        // country is the remote host's country code, if known (see -geoip).
+		asn        int           // asn is the remote host's autonomous system number, if known (see -asn).
+		asOrg      string        // asOrg is the remote host's autonomous system organization, if known.
+		referer    string        // referer is the Referer header, with the combined log format.
+		userAgent  string        // userAgent is the User-Agent header, with the combined log format.
+		agent      uaClass       // agent is the user agent's classification, with the combined log format.
 	}
 )
 
@@ -44,7 +55,7 @@ var logRegex = regexp.MustCompile( // ^(\S+)\s(\S+)\s(\S+)\s\[(.*)\]\s\"(\S+)\s(
 		`(\S+)\"\s` + // request.httpVers
 		`(\S+)\s` + // respCode
 		`(\S+)` + // txBytes
-		`.*`)
+		`(.*)`) // the rest, e.g. referer, user agent, forwarded for, and request duration
 
 // parseLine parses a log line and returns a logEntry for further processing.
 func parseLine(s string) (logEntry, error) {
@@ -66,10 +77,109 @@ func parseLine(s string) (logEntry, error) {
 		respCode: atoi(parts[8]),
 		txBytes:  atoi(parts[9]),
 	}
+	rest := strings.Fields(parts[10])
+	if len(rest) > 0 {
+		entry.duration, entry.timed = parseLatency(rest[len(rest)-1], latencyUnit)
+	}
+	quoted := quotedFields(parts[10])
+	if len(quoted) >= 2 {
+		// combined log format: "referer" "user agent"
+		entry.referer, entry.userAgent, entry.agent = quoted[0], quoted[1], agents.classify(quoted[1])
+	}
+	if forwardedField > 0 && len(quoted) >= forwardedField {
+		entry.remoteHost = resolveClient(entry.remoteHost, quoted[forwardedField-1])
+	}
 
 	return entry, nil
 }
 
+// MarshalJSON allows logEntry to implement the json.Marshaler interface.
+func (e logEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		RemoteHost string   `json:"remoteHost"`
+		UserId     string   `json:"userId"`
+		AuthUser   string   `json:"authUser"`
+		Date       string   `json:"date"`
+		Method     string   `json:"method"`
+		Path       string   `json:"path"`
+		Section    string   `json:"section"`
+		HttpVers   string   `json:"httpVers"`
+		RespCode   int      `json:"respCode"`
+		TxBytes    int      `json:"txBytes"`
+		DurationMs *float64 `json:"durationMs,omitempty"`
+		Country    string   `json:"country,omitempty"`
+		ASN        int      `json:"asn,omitempty"`
+		ASOrg      string   `json:"asOrg,omitempty"`
+		Referer    string   `json:"referer,omitempty"`
+		UserAgent  string   `json:"userAgent,omitempty"`
+		Agent      string   `json:"agent,omitempty"`
+	}{
+		RemoteHost: e.remoteHost,
+		UserId:     e.userId,
+		AuthUser:   e.authUser,
+		Date:       e.date,
+		Method:     e.request.method,
+		Path:       e.request.path,
+		Section:    sectionOf(e.request.path),
+		HttpVers:   e.request.httpVers,
+		RespCode:   e.respCode,
+		TxBytes:    e.txBytes,
+		DurationMs: e.durationMs(),
+		Country:    e.country,
+		ASN:        e.asn,
+		ASOrg:      e.asOrg,
+		Referer:    e.referer,
+		UserAgent:  e.userAgent,
+		Agent:      e.agentName(),
+	})
+}
+
+// durationMs returns the request duration in milliseconds, or nil if it wasn't timed.
+func (e logEntry) durationMs() *float64 {
+	if !e.timed {
+		return nil
+	}
+	ms := millis(e.duration)
+	return &ms
+}
+
+// agentName returns the user agent's classification, e.g. "crawler Googlebot", or "" if the line
+// had no user agent.
+func (e logEntry) agentName() string {
+	if e.agent.family == "" {
+		return ""
+	}
+	return e.agent.String()
+}
+
+// quotedFields returns the double quoted fields in s, unescaping \" and \\.
+// example: `"-" "curl/8.0 \"x\"" 0.010` -> ["-", `curl/8.0 "x"`]
+func quotedFields(s string) []string {
+	var out []string
+	var field []byte
+	in, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case !in:
+			if c == '"' {
+				in, field = true, field[:0]
+			}
+		case escaped:
+			field = append(field, c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			out = append(out, string(field))
+			in = false
+		default:
+			field = append(field, c)
+		}
+	}
+	return out
+}
+
 // atoi parses a string and returns an int (0 if there was an error).
 func atoi(s string) int {
 	i, err := strconv.Atoi(s)
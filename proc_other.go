@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "os/exec"
+
+// setProcessGroup does nothing where process groups aren't supported.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcess kills cmd's process.
+func killProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -1,3 +1,6 @@
+//go:build !windows
+// +build !windows
+
 package main
 
 import (
@@ -10,29 +13,48 @@ import (
 )
 
 func init() {
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	go watchSig(sigs)
-	signal.Notify(sigs, syscall.SIGHUP)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1)
 }
 
+// watchSig reopens output files (so external logrotate works) and reloads the silence and user
+// agent rule files on SIGHUP, and writes a heap profile on SIGUSR1.
 func watchSig(sig chan os.Signal) {
-	for {
-		select {
-		case <-sig:
-			f, err := os.Create(fmt.Sprintf("./mem-%s.mprof", time.Now().Format("15:04:05.1234")))
-			if err != nil {
-				fmt.Println(err)
-				return
+	for s := range sig {
+		switch s {
+		case syscall.SIGHUP:
+			outputs.reopen()
+			if silenceFile != "" {
+				if err := silences.load(silenceFile); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reload silences - %s\n", err.Error())
+				}
+			}
+			if uaRulesFile != "" {
+				if err := agents.load(uaRulesFile); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reload user agent rules - %s\n", err.Error())
+				}
 			}
-			fmt.Println("Writing profile...")
-			// runtime.GC() //get up to date stats
-			pprof.WriteHeapProfile(f)
-			f.Close()
-			fmt.Println("Profile wrote")
+		case syscall.SIGUSR1:
+			writeProfile()
 		}
 	}
 }
 
+// writeProfile writes a heap profile to the working directory.
+func writeProfile() {
+	f, err := os.Create(fmt.Sprintf("./mem-%s.mprof", time.Now().Format("15:04:05.1234")))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Writing profile...")
+	// runtime.GC() //get up to date stats
+	pprof.WriteHeapProfile(f)
+	f.Close()
+	fmt.Fprintln(os.Stderr, "Profile wrote")
+}
+
 /*
 // after 434859 logs dumped rapidly to the log file
 // `ps` shows ~1.3GB
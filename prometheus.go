@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// promSink accumulates reports and alerts into counters served in the prometheus text format.
+	promSink struct {
+		requests  map[string]int64        // requests is the total requests per section, for the first -section-top sections seen, and the rest as "other".
+		responses map[int]int64           // responses is the total responses per status code.
+		txBytes   int64                   // txBytes is the total bytes transmitted.
+		slo       *sloStatus              // slo is the latest error budget, if an objective is set.
+		visitors  map[string]visitorCount // visitors are the latest unique visitor estimates, for the "interval" and the "window".
+		firing    map[alertKey]bool       // firing is whether each rule's alert is triggered (security alerts only while triggered).
+		alerts    map[string]int64        // alerts is how many times each rule's alert triggered.
+		tex       *sync.RWMutex           // tex is the lock for all of the above.
+	}
+
+	// alertKey identifies an alert: a rule, and for security alerts, the offending client.
+	alertKey struct {
+		rule       string // rule is the name of the rule.
+		remoteHost string // remoteHost is the offending client, for security alerts.
+	}
+)
+
+// promEscaper escapes label values the way the exposition format expects: only backslashes, double
+// quotes, and newlines.
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics is the prometheus sink, nil unless configured with "-o prometheus".
+var metrics *promSink
+
+// newPromSink returns a pointer to a new promSink.
+func newPromSink() *promSink {
+	return &promSink{
+		requests:  map[string]int64{},
+		responses: map[int]int64{},
+		visitors:  map[string]visitorCount{},
+		firing:    map[alertKey]bool{},
+		alerts:    map[string]int64{},
+		tex:       &sync.RWMutex{},
+	}
+}
+
+// report allows promSink to implement the sink interface.
+func (p *promSink) report(s stats) {
+	p.tex.Lock()
+	defer p.tex.Unlock()
+	for i := range s.requests {
+		section := s.requests[i].section
+		if _, ok := p.requests[section]; !ok && len(p.requests) >= sectionTop {
+			section = "other"
+		}
+		p.requests[section] += int64(s.requests[i].count)
+	}
+	for i := range s.responses {
+		p.responses[s.responses[i].code] += int64(s.responses[i].count)
+	}
+	p.txBytes += int64(s.txBytes)
+	if s.slo != nil {
+		p.slo = s.slo
+	}
+	if v, ok := s.visitorCounts()[""]; ok {
+		p.visitors["interval"] = v
+	}
+	if s.windowVisitors != nil {
+		p.visitors["window"] = *s.windowVisitors
+	}
+}
+
+// alert allows promSink to implement the sink interface.
+func (p *promSink) alert(a alertEvent) {
+	p.tex.Lock()
+	defer p.tex.Unlock()
+	k := alertKey{rule: a.Rule, remoteHost: a.RemoteHost}
+	if a.Triggered {
+		p.alerts[a.Rule]++
+	}
+	if a.RemoteHost != "" && !a.Triggered {
+		// recovered clients are forgotten, so attackers can't grow the series without bound
+		delete(p.firing, k)
+		return
+	}
+	p.firing[k] = a.Triggered
+}
+
+// ServeHTTP allows promSink to implement the http.Handler interface.
+func (p *promSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.tex.RLock()
+	defer p.tex.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	sections := make([]string, 0, len(p.requests))
+	for k := range p.requests {
+		sections = append(sections, k)
+	}
+	sort.Strings(sections)
+	fmt.Fprintln(w, "# HELP bver_requests_total Requests seen per section.")
+	fmt.Fprintln(w, "# TYPE bver_requests_total counter")
+	for _, k := range sections {
+		fmt.Fprintf(w, "bver_requests_total{section=%s} %d\n", promLabel(k), p.requests[k])
+	}
+
+	codes := make([]int, 0, len(p.responses))
+	for k := range p.responses {
+		codes = append(codes, k)
+	}
+	sort.Ints(codes)
+	fmt.Fprintln(w, "# HELP bver_responses_total Responses seen per status code.")
+	fmt.Fprintln(w, "# TYPE bver_responses_total counter")
+	for _, k := range codes {
+		fmt.Fprintf(w, "bver_responses_total{code=\"%d\"} %d\n", k, p.responses[k])
+	}
+
+	fmt.Fprintln(w, "# HELP bver_transmitted_bytes_total Bytes transmitted to clients.")
+	fmt.Fprintln(w, "# TYPE bver_transmitted_bytes_total counter")
+	fmt.Fprintf(w, "bver_transmitted_bytes_total %d\n", p.txBytes)
+
+	if len(p.visitors) > 0 {
+		scopes := make([]string, 0, len(p.visitors))
+		for k := range p.visitors {
+			scopes = append(scopes, k)
+		}
+		sort.Strings(scopes)
+		fmt.Fprintln(w, "# HELP bver_unique_visitors Estimated unique remote hosts in the last report interval or over the -d window.")
+		fmt.Fprintln(w, "# TYPE bver_unique_visitors gauge")
+		for _, k := range scopes {
+			fmt.Fprintf(w, "bver_unique_visitors{scope=%s} %d\n", promLabel(k), p.visitors[k].Estimate)
+		}
+		fmt.Fprintln(w, "# HELP bver_unique_visitors_error Standard error of bver_unique_visitors.")
+		fmt.Fprintln(w, "# TYPE bver_unique_visitors_error gauge")
+		for _, k := range scopes {
+			fmt.Fprintf(w, "bver_unique_visitors_error{scope=%s} %d\n", promLabel(k), p.visitors[k].Error)
+		}
+	}
+
+	if p.slo != nil {
+		fmt.Fprintln(w, "# HELP bver_slo_budget_remaining Fraction of the SLO's error budget left.")
+		fmt.Fprintln(w, "# TYPE bver_slo_budget_remaining gauge")
+		fmt.Fprintf(w, "bver_slo_budget_remaining %g\n", p.slo.Remaining)
+		windows := make([]string, 0, len(p.slo.Burns))
+		for k := range p.slo.Burns {
+			windows = append(windows, k)
+		}
+		sort.Strings(windows)
+		fmt.Fprintln(w, "# HELP bver_slo_burn_rate How many times faster than sustainable the error budget burned.")
+		fmt.Fprintln(w, "# TYPE bver_slo_burn_rate gauge")
+		for _, k := range windows {
+			fmt.Fprintf(w, "bver_slo_burn_rate{window=%s} %g\n", promLabel(k), p.slo.Burns[k])
+		}
+	}
+
+	names := make([]alertKey, 0, len(p.firing))
+	for k := range p.firing {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].rule != names[j].rule {
+			return names[i].rule < names[j].rule
+		}
+		return names[i].remoteHost < names[j].remoteHost
+	})
+	fmt.Fprintln(w, "# HELP bver_alert_firing Whether a rule's alert is triggered (per client, while triggered, for security alerts).")
+	fmt.Fprintln(w, "# TYPE bver_alert_firing gauge")
+	for _, k := range names {
+		firing := 0
+		if p.firing[k] {
+			firing = 1
+		}
+		fmt.Fprintf(w, "bver_alert_firing{%s} %d\n", k.labels(), firing)
+	}
+	fmt.Fprintln(w, "# HELP bver_alerts_total Times a rule's alert triggered.")
+	fmt.Fprintln(w, "# TYPE bver_alerts_total counter")
+	rules := make([]string, 0, len(p.alerts))
+	for k := range p.alerts {
+		rules = append(rules, k)
+	}
+	sort.Strings(rules)
+	for _, k := range rules {
+		fmt.Fprintf(w, "bver_alerts_total{rule=%s} %d\n", promLabel(k), p.alerts[k])
+	}
+}
+
+// labels returns the alert's prometheus labels, with remote_host only for security alerts.
+func (k alertKey) labels() string {
+	if k.remoteHost == "" {
+		return "rule=" + promLabel(k.rule)
+	}
+	return "rule=" + promLabel(k.rule) + ",remote_host=" + promLabel(k.remoteHost)
+}
+
+// promLabel returns s as a quoted prometheus label value.
+func promLabel(s string) string {
+	return `"` + promEscaper.Replace(s) + `"`
+}
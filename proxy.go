@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// trustedProxies are the -trusted-proxy networks, whose forwarded headers are believed.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of networks in CIDR notation, or single
+// addresses.
+// example: 10.0.0.0/8,192.0.2.7,2001:db8::/32
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// trusted returns true if ip is in a trusted proxy network.
+func trusted(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClient returns the client address for a request from the peer remote that forwarded the
+// X-Forwarded-For (or X-Real-IP) header forwarded. Walking the chain from the right, each trusted
+// proxy is skipped and the first untrusted address is the client, since anything left of it could
+// be forged. If the peer isn't trusted, the header is ignored. An unparseable hop ("unknown")
+// stops the walk at the proxy that reported it.
+// example: peer 10.0.0.2, header "6.6.6.6, 203.0.113.9, 10.0.0.1" -> "203.0.113.9"
+func resolveClient(remote, forwarded string) string {
+	client := clientHost(remote)
+	ip := net.ParseIP(client)
+	if ip == nil || !trusted(ip) || forwarded == "" || forwarded == "-" {
+		return remote
+	}
+	hops := strings.Split(forwarded, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := clientHost(strings.TrimSpace(hops[i]))
+		hip := net.ParseIP(hop)
+		if hip == nil {
+			return client
+		}
+		client = hop
+		if !trusted(hip) {
+			return client
+		}
+	}
+	// every hop is a proxy, so the leftmost is as close to the client as we know
+	return client
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	// hotlinkMin is how many static asset requests a section needs in an interval before it can be
+	// flagged as hotlinked.
+	hotlinkMin = 10
+	// refererTop is how many of the busiest referring domains reports show.
+	refererTop = 10
+)
+
+// assetExts are the extensions of static assets, which other sites may embed (hotlink).
+var assetExts = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".svg": true, ".ico": true,
+	".css": true, ".js": true, ".woff": true, ".woff2": true, ".ttf": true,
+	".mp3": true, ".mp4": true, ".webm": true, ".pdf": true, ".zip": true,
+}
+
+// siteHosts are the -site hosts, whose referers are same-site.
+var siteHosts []string
+
+// refererHost returns the lowercased host of a referer, or "" if there isn't one.
+// example: "https://News.example.com:443/item?id=1" -> "news.example.com"
+func refererHost(referer string) string {
+	if referer == "" || referer == "-" {
+		return ""
+	}
+	u, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// sameSite returns true if host is a -site host or a subdomain of one.
+func sameSite(host string) bool {
+	for _, h := range siteHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAsset returns true if a request path is for a static asset, by its extension.
+func isAsset(p string) bool {
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	return assetExts[strings.ToLower(path.Ext(p))]
+}
+
+// refererRequest returns the request an entry counts toward its section, noting whether it's a
+// static asset linked from another site. Referers are only external with -site.
+func refererRequest(e logEntry) request {
+	r := request{section: e.request.path, count: 1}
+	if isAsset(e.request.path) {
+		r.assets = 1
+		if host := refererHost(e.referer); host != "" && len(siteHosts) > 0 && !sameSite(host) {
+			r.hotlinks = 1
+		}
+	}
+	return r
+}
+
+// addReferer counts an entry's referring domain for the interval. With -site, same-site referers
+// are only counted in total.
+func (s *stats) addReferer(e logEntry) {
+	host := refererHost(e.referer)
+	if host == "" {
+		return
+	}
+	s.reqTex.Lock()
+	defer s.reqTex.Unlock()
+	if len(siteHosts) > 0 && sameSite(host) {
+		s.sameSite++
+		return
+	}
+	if s.referers == nil {
+		s.referers = map[string]int{}
+	}
+	s.referers[host]++
+	s.external++
+}
+
+// hotlinked returns true if most of a section's static asset requests were linked from other
+// sites (more than -hotlink of at least hotlinkMin).
+func (r request) hotlinked() bool {
+	return hotlinkRatio > 0 && r.assets >= hotlinkMin && float64(r.hotlinks) >= hotlinkRatio*float64(r.assets)
+}
+
+// printReferers prints the busiest referring domains to w, and with -site, how many referers were
+// same-site and external.
+func (s stats) printReferers(w io.Writer) {
+	if len(s.topReferers) == 0 && s.sameSite == 0 {
+		return
+	}
+	if len(siteHosts) > 0 {
+		fmt.Fprintf(w, "Referers (%d same-site, %d external):\n", s.sameSite, s.external)
+	} else {
+		fmt.Fprintln(w, "Referers:")
+	}
+	for _, c := range s.topReferers {
+		fmt.Fprintf(w, "%3d %s\n", c.Count, c.Key)
+	}
+	fmt.Fprintln(w)
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,18 +15,38 @@ import (
 type (
 	// stats defines collectable stats from a common log formatted entry.
 	stats struct {
-		requests   reqSlice      // requests is a slice of requests.
-		reqTex     *sync.RWMutex // reqTex is requests' lock.
-		responses  resSlice      // responses is a slice of responses.
-		resTex     *sync.RWMutex // resTex is responses' lock.
-		txBytes    int           // txBytes is the total bytes transmitted to the client.
-		reportFreq int           // reportFreq is how frequently to print a summary.
+		requests       reqSlice                  // requests is a slice of requests.
+		reqTex         *sync.RWMutex             // reqTex is requests' lock.
+		responses      resSlice                  // responses is a slice of responses.
+		resTex         *sync.RWMutex             // resTex is responses' lock.
+		txBytes        int                       // txBytes is the total bytes transmitted to the client.
+		reportFreq     int                       // reportFreq is how frequently to print a summary.
+		end            time.Time                 // end is when the interval ended. (only set on snapshots)
+		slo            *sloStatus                // slo is the error budget, if an objective is set. (only set on snapshots)
+		latencies      map[string]*latencySketch // latencies are the request durations overall ("") and per section. (guarded by reqTex)
+		visitors       map[string]*hll           // visitors are the unique remote hosts overall ("") and per section. (guarded by reqTex)
+		windowVisitors *visitorCount             // windowVisitors are the unique remote hosts over the -d window. (only set on snapshots)
+		windowSeconds  int                       // windowSeconds is how long windowVisitors covers. (only set on snapshots)
+		clients        *talkerTable              // clients are the heaviest remote hosts, with -clients. (guarded by reqTex)
+		topClients     []clientCount             // topClients are the -clients heaviest remote hosts by hits. (only set on snapshots)
+		countries      map[string]int            // countries are the requests per country, with -geoip. (guarded by reqTex)
+		networks       map[string]int            // networks are the requests per autonomous system, with -asn. (guarded by reqTex)
+		topCountries   []keyCount                // topCountries are the -geo-top busiest countries. (only set on snapshots)
+		topNetworks    []keyCount                // topNetworks are the -geo-top busiest autonomous systems. (only set on snapshots)
+		agents         map[string]int            // agents are the requests per user agent classification. (guarded by reqTex)
+		topAgents      []keyCount                // topAgents are the agentTop busiest user agent classifications. (only set on snapshots)
+		referers       map[string]int            // referers are the requests per referring domain, external only with -site. (guarded by reqTex)
+		sameSite       int                       // sameSite is how many requests had a -site referer. (guarded by reqTex)
+		external       int                       // external is how many requests had a referer that isn't same-site. (guarded by reqTex)
+		topReferers    []keyCount                // topReferers are the refererTop busiest referring domains. (only set on snapshots)
 	}
 
 	// request defines a countable request.
 	request struct {
-		count   int    // count is the count of occurrences of the section.
-		section string // section is the first part of the path requested. (if path == "/pages/thing", section = "/pages")
+		count    int    // count is the count of occurrences of the section.
+		section  string // section is the first part of the path requested. (if path == "/pages/thing", section = "/pages")
+		assets   int    // assets is how many of the requests were for static assets.
+		hotlinks int    // hotlinks is how many of the static asset requests had an external referer (see -site).
 	}
 
 	// response defines a countable response.
@@ -37,8 +60,8 @@ type (
 	resSlice []response // resSlice is a slice of responses.
 )
 
-// buildReport aggregates collected statistics and prints the data when configured.
-func buildReport(ctx context.Context, e chan logEntry, s *satMon, reportFreq int) {
+// buildReport aggregates collected statistics and sends a snapshot to the outputs when configured.
+func buildReport(ctx context.Context, e chan logEntry, rs rules, reportFreq int) {
 	var t = time.Tick(time.Second * time.Duration(reportFreq))
 
 	report := stats{
@@ -47,18 +70,49 @@ func buildReport(ctx context.Context, e chan logEntry, s *satMon, reportFreq int
 		reportFreq: reportFreq,
 	}
 
-	go s.monitor(ctx)
+	window := newVisitorWindow(duration, reportFreq)
+
+	rs.monitor(ctx)
 
 	for {
 		select {
 		case <-t:
-			report.print()
+			snap := report.snapshot()
+			if objective != nil {
+				st := objective.status(snap.end)
+				snap.slo = &st
+			}
+			wv := window.count()
+			snap.windowVisitors, snap.windowSeconds = &wv, window.seconds
+			window.advance()
+			if contributors != nil {
+				contributors.advance()
+			}
+			outputs.report(snap)
 			report.clear()
 		case entry := <-e:
-			s.push()
-			report.addRequest(request{section: entry.request.path, count: 1})
+			rs.observe(entry)
+			report.addRequest(refererRequest(entry))
+			report.addReferer(entry)
 			report.addResponse(response{code: entry.respCode, count: 1})
 			report.txBytes += entry.txBytes
+			report.addVisitor(entry)
+			window.add(clientHost(entry.remoteHost))
+			if topClients > 0 {
+				report.addClient(entry)
+			}
+			if contributors != nil {
+				contributors.add(entry)
+			}
+			if entry.timed {
+				report.addLatency(entry)
+			}
+			if entry.agent.family != "" {
+				report.addAgent(entry)
+			}
+			if entry.country != "" || entry.asn != 0 {
+				report.addGeo(entry)
+			}
 		case <-ctx.Done():
 			return
 		}
@@ -72,31 +126,178 @@ func (s *stats) clear() {
 	defer s.reqTex.Unlock()
 	defer s.resTex.Unlock()
 	s.requests = reqSlice{}
+	s.latencies = nil
+	s.visitors = nil
+	s.clients = nil
+	s.countries = nil
+	s.networks = nil
+	s.agents = nil
+	s.referers = nil
+	s.sameSite = 0
+	s.external = 0
 	s.responses = resSlice{}
 	s.txBytes = 0
 }
 
-// print prints the summarized stats.
-func (s stats) print() {
+// print prints the summarized stats to w.
+func (s stats) print(w io.Writer) error {
 	// check whether to print header/footer (each printer has it's own check)
 	if s.txBytes == 0 && len(s.responses) == 0 && len(s.requests) == 0 {
-		return
+		return nil
+	}
+	fmt.Fprintln(w, "---------------------------------------")
+	s.printRequest(w)
+	s.printResponse(w)
+	s.printLatency(w)
+	s.printReferers(w)
+	s.printVisitors(w)
+	s.printClients(w)
+	s.printGeo(w)
+	s.printAgents(w)
+	if s.slo != nil {
+		s.slo.print(w)
+	}
+	s.printTxBytes(w)
+	_, err := fmt.Fprintln(w, "=======================================")
+	return err
+}
+
+// snapshot returns a sorted copy of the stats that is safe to hand to other goroutines.
+func (s *stats) snapshot() stats {
+	s.reqTex.RLock()
+	s.resTex.RLock()
+	defer s.reqTex.RUnlock()
+	defer s.resTex.RUnlock()
+	snap := stats{
+		requests:   append(reqSlice{}, s.requests...),
+		reqTex:     &sync.RWMutex{},
+		responses:  append(resSlice{}, s.responses...),
+		resTex:     &sync.RWMutex{},
+		txBytes:    s.txBytes,
+		reportFreq: s.reportFreq,
+		end:        time.Now(),
+		sameSite:   s.sameSite,
+		external:   s.external,
+	}
+	if len(s.latencies) > 0 {
+		snap.latencies = map[string]*latencySketch{}
+		for key, ls := range s.latencies {
+			snap.latencies[key] = newLatencySketch()
+			snap.latencies[key].merge(ls)
+		}
+	}
+	if len(s.visitors) > 0 {
+		snap.visitors = map[string]*hll{}
+		for key, h := range s.visitors {
+			snap.visitors[key] = h.clone()
+		}
+	}
+	if s.clients != nil {
+		snap.topClients = s.clients.top(topClients, "hits")
+	}
+	if len(s.countries) > 0 {
+		snap.topCountries = topCounts(s.countries, geoTop)
+	}
+	if len(s.networks) > 0 {
+		snap.topNetworks = topCounts(s.networks, geoTop)
 	}
-	fmt.Println("---------------------------------------")
-	s.printRequest()
-	s.printResponse()
-	s.printTxBytes()
-	fmt.Println("=======================================")
+	if len(s.agents) > 0 {
+		snap.topAgents = topCounts(s.agents, agentTop)
+	}
+	if len(s.referers) > 0 {
+		snap.topReferers = topCounts(s.referers, refererTop)
+	}
+	sort.Sort(snap.requests)
+	sort.Sort(snap.responses)
+	return snap
+}
+
+// MarshalJSON allows stats to implement the json.Marshaler interface. Stats are expected to
+// already be sorted (see snapshot).
+func (s stats) MarshalJSON() ([]byte, error) {
+	type count struct {
+		Key       string `json:"key"`
+		Count     int    `json:"count"`
+		Hotlinked bool   `json:"hotlinked,omitempty"`
+	}
+	out := struct {
+		Requests  []count    `json:"requests"`
+		Responses []count    `json:"responses"`
+		TxBytes   int        `json:"txBytes"`
+		Interval  int        `json:"interval"`
+		SLO       *sloStatus `json:"slo,omitempty"`
+		Visitors  *struct {
+			Interval visitorCount            `json:"interval"`
+			Window   *visitorCount           `json:"window,omitempty"`
+			Seconds  int                     `json:"windowSeconds,omitempty"`
+			Sections map[string]visitorCount `json:"sections"`
+		} `json:"visitors,omitempty"`
+		Latency *struct {
+			All      latencySummary            `json:"all"`
+			Sections map[string]latencySummary `json:"sections"`
+		} `json:"latency,omitempty"`
+		Clients   []clientCount `json:"clients,omitempty"`
+		Countries []keyCount    `json:"countries,omitempty"`
+		Networks  []keyCount    `json:"networks,omitempty"`
+		Agents    []keyCount    `json:"agents,omitempty"`
+		Referers  *struct {
+			SameSite int        `json:"sameSite"`
+			External int        `json:"external"`
+			Domains  []keyCount `json:"domains"`
+		} `json:"referers,omitempty"`
+	}{
+		Requests:  []count{},
+		Responses: []count{},
+		TxBytes:   s.txBytes,
+		Interval:  s.reportFreq,
+		SLO:       s.slo,
+		Clients:   s.topClients,
+		Countries: s.topCountries,
+		Networks:  s.topNetworks,
+		Agents:    s.topAgents,
+	}
+	for i := range s.requests {
+		out.Requests = append(out.Requests, count{Key: s.requests[i].section, Count: s.requests[i].count, Hotlinked: s.requests[i].hotlinked()})
+	}
+	for i := range s.responses {
+		out.Responses = append(out.Responses, count{Key: strconv.Itoa(s.responses[i].code), Count: s.responses[i].count})
+	}
+	if len(s.topReferers) > 0 || s.sameSite > 0 {
+		out.Referers = &struct {
+			SameSite int        `json:"sameSite"`
+			External int        `json:"external"`
+			Domains  []keyCount `json:"domains"`
+		}{SameSite: s.sameSite, External: s.external, Domains: append([]keyCount{}, s.topReferers...)}
+	}
+	if len(s.visitors) > 0 {
+		counts := s.visitorCounts()
+		out.Visitors = &struct {
+			Interval visitorCount            `json:"interval"`
+			Window   *visitorCount           `json:"window,omitempty"`
+			Seconds  int                     `json:"windowSeconds,omitempty"`
+			Sections map[string]visitorCount `json:"sections"`
+		}{Interval: counts[""], Window: s.windowVisitors, Seconds: s.windowSeconds, Sections: counts}
+		delete(counts, "")
+	}
+	if len(s.latencies) > 0 {
+		sums := s.latencySummaries()
+		out.Latency = &struct {
+			All      latencySummary            `json:"all"`
+			Sections map[string]latencySummary `json:"sections"`
+		}{All: sums[""], Sections: sums}
+		delete(sums, "")
+	}
+	return json.Marshal(out)
 }
 
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 // TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE TXBYTE
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
-// printTxBytes prints the transmitted bytes.
-func (s stats) printTxBytes() {
+// printTxBytes prints the transmitted bytes to w.
+func (s stats) printTxBytes(w io.Writer) {
 	if s.txBytes != 0 {
-		fmt.Printf("Transmitted:\n %dbps\n", s.txBytes/s.reportFreq)
+		fmt.Fprintf(w, "Transmitted:\n %dbps\n", s.txBytes/s.reportFreq)
 	}
 }
 
@@ -118,19 +319,19 @@ func (s *stats) addResponse(r response) {
 	s.responses = append(s.responses, r)
 }
 
-// printResponse prints the response stats.
-func (s stats) printResponse() {
+// printResponse prints the response stats to w.
+func (s stats) printResponse(w io.Writer) {
 	if len(s.responses) == 0 {
 		return
 	}
 	s.resTex.RLock()
 	defer s.resTex.RUnlock()
 	sort.Sort(s.responses)
-	fmt.Println("Responses:")
+	fmt.Fprintln(w, "Responses:")
 	for i := range s.responses {
-		fmt.Printf("%3d %d\n", s.responses[i].count, s.responses[i].code)
+		fmt.Fprintf(w, "%3d %d\n", s.responses[i].count, s.responses[i].code)
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 }
 
 // Sort interface methods
@@ -164,35 +365,44 @@ func (s *stats) addRequest(r request) {
 	s.reqTex.Lock()
 	defer s.reqTex.Unlock()
 
-	section := "/"
-	if strings.Count(r.section, "/") > 1 {
-		section = "/" + strings.FieldsFunc(r.section, func(c rune) bool { return c == '/' })[0]
-	}
-
-	r.section = section
+	r.section = sectionOf(r.section)
 
 	for i := range s.requests {
 		if s.requests[i].section == r.section {
 			s.requests[i].count++
+			s.requests[i].assets += r.assets
+			s.requests[i].hotlinks += r.hotlinks
 			return
 		}
 	}
 	s.requests = append(s.requests, r)
 }
 
-// printRequest prints the request stats.
-func (s stats) printRequest() {
+// sectionOf returns the section of a request path. (if path == "/pages/thing", section = "/pages")
+func sectionOf(path string) string {
+	if strings.Count(path, "/") > 1 {
+		return "/" + strings.FieldsFunc(path, func(c rune) bool { return c == '/' })[0]
+	}
+	return "/"
+}
+
+// printRequest prints the request stats to w.
+func (s stats) printRequest(w io.Writer) {
 	if len(s.requests) == 0 {
 		return
 	}
 	s.reqTex.RLock()
 	defer s.reqTex.RUnlock()
 	sort.Sort(s.requests)
-	fmt.Println("Requests:")
+	fmt.Fprintln(w, "Requests:")
 	for i := range s.requests {
-		fmt.Printf("%3d %s\n", s.requests[i].count, s.requests[i].section)
+		if r := s.requests[i]; r.hotlinked() {
+			fmt.Fprintf(w, "%3d %s (possible hotlinking, %d of %d assets linked from other sites)\n", r.count, r.section, r.hotlinks, r.assets)
+			continue
+		}
+		fmt.Fprintf(w, "%3d %s\n", s.requests[i].count, s.requests[i].section)
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 }
 
 // Sort interface methods
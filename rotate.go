@@ -0,0 +1,201 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an append-only file that is rotated when it grows too big or too old.
+type rotatingFile struct {
+	path     string        // path is the location of the live file.
+	maxSize  int64         // maxSize is the size in bytes at which to rotate (never if 0).
+	maxAge   time.Duration // maxAge is how long to write to a file before rotating (never if 0).
+	keep     int           // keep is how many rotated files to retain (all if 0).
+	compress bool          // compress is whether to gzip rotated files.
+	file     *os.File      // file is the open live file.
+	size     int64         // size is the current size of the live file.
+	opened   time.Time     // opened is when the live file was started.
+	tex      *sync.Mutex   // tex is the lock for file, size, and opened.
+}
+
+// rotateStamp is the suffix format of rotated files. It sorts oldest to newest.
+const rotateStamp = "20060102-150405.000000000"
+
+// openRotatingFile opens (creating if needed) a rotatingFile at path.
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int, compress bool) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		keep:     keep,
+		compress: compress,
+		tex:      &sync.Mutex{},
+	}
+	return r, r.open()
+}
+
+// open opens the live file. r.tex must be held (or r not yet shared).
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = fi.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+// Write allows rotatingFile to implement the io.Writer interface.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.tex.Lock()
+	defer r.tex.Unlock()
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// empty returns true if nothing has been written to the live file.
+func (r *rotatingFile) empty() bool {
+	r.tex.Lock()
+	defer r.tex.Unlock()
+	return r.size == 0
+}
+
+// due returns true if the live file should be rotated before more is written.
+func (r *rotatingFile) due() bool {
+	r.tex.Lock()
+	defer r.tex.Unlock()
+	if r.size == 0 {
+		return false
+	}
+	return (r.maxSize > 0 && r.size >= r.maxSize) || (r.maxAge > 0 && time.Since(r.opened) >= r.maxAge)
+}
+
+// rotate moves the live file aside (compressing it if configured), starts a new one, and removes
+// rotated files beyond the retention count.
+func (r *rotatingFile) rotate() error {
+	r.tex.Lock()
+	defer r.tex.Unlock()
+
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	rotated := r.path + "." + time.Now().Format(rotateStamp)
+	if err := os.Rename(r.path, rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	if r.compress {
+		if err := gzipFile(rotated); err != nil {
+			return fmt.Errorf("Failed to compress %s - %s", rotated, err.Error())
+		}
+	}
+	return r.prune()
+}
+
+// reopen closes and reopens the live file, for when something else (like logrotate) moved it.
+func (r *rotatingFile) reopen() error {
+	r.tex.Lock()
+	defer r.tex.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	return r.open()
+}
+
+// Close allows rotatingFile to implement the io.Closer interface.
+func (r *rotatingFile) Close() error {
+	r.tex.Lock()
+	defer r.tex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// prune removes the oldest rotated files beyond the retention count. r.tex must be held.
+func (r *rotatingFile) prune() error {
+	if r.keep < 1 {
+		return nil
+	}
+	rotated, err := r.rotated()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > r.keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// rotated returns the rotated files, oldest first.
+func (r *rotatingFile) rotated() ([]string, error) {
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, r.path+"."), ".gz")
+		if _, err := time.Parse(rotateStamp, stamp); err == nil {
+			out = append(out, m)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// gzipFile compresses path to path.gz and removes the original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -3,26 +3,112 @@ package main
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
-// satMon defines a saturation monitor.
-type satMon struct {
-	count     int64         // count is the number of occurrences.
-	threshold int64         // threshold is the upper limit before an alert is "triggerred."
-	ttl       time.Duration // ttl is the size of the window the threshold applies to.
-}
+type (
+	// satMon defines a saturation monitor: an alert rule evaluated over a sliding window.
+	satMon struct {
+		count     int64         // count is the number of occurrences (or bytes) in the window.
+		total     int64         // total is the number of matching requests in the window, for ratios.
+		threshold float64       // threshold is the limit before an alert is "triggerred."
+		ttl       time.Duration // ttl is the size of the window the threshold applies to.
+		name      string        // name identifies the rule in alerts.
+		metric    string        // metric is what is measured: hits, bytes, 5xx, errorRatio, or idle.
+		op        string        // op is how the metric is compared to the threshold: >=, >, <=, or <.
+		section   string        // section limits the rule to one section (all if empty).
+		country   string        // country limits the rule to one country code, e.g. "US" (all if empty, see -geoip).
+		noBots    bool          // noBots is whether the rule ignores crawlers, bots, and http libraries.
+		status    string        // status limits the rule to matching status codes, e.g. "4xx" (all if empty).
+		minTotal  int64         // minTotal is how many requests the window needs before a ratio can trigger.
+		with4xx   bool          // with4xx is whether 4xx responses count as errors in ratios.
+		started   int64         // started is when monitoring began (unix nanoseconds).
+		last      int64         // last is when a line was last read from the source (unix nanoseconds).
+		recovery  float64       // recovery is the threshold the value must cross back over to recover (threshold if 0).
+		pendFor   time.Duration // pendFor is how long the threshold must be crossed before firing.
+		resFor    time.Duration // resFor is how long the recovery threshold must be crossed before resolving.
+		state     alertState    // state is where the rule is in its alert lifecycle. (only used by monitor)
+		since     time.Time     // since is when the rule entered its state. (only used by monitor)
+		restored  bool          // restored is whether the rule was restored firing, so can't resolve until its window fills.
+	}
+
+	// alertState is a step in a rule's alert lifecycle: inactive -> pending -> firing -> resolving.
+	// Pending and resolving rules fall back to inactive and firing if the condition doesn't hold.
+	alertState int
+
+	// rule defines an alert rule that can be monitored.
+	rule interface {
+		monitor(ctx context.Context)          // monitor evaluates the rule until ctx is done.
+		observe(e logEntry)                   // observe counts an entry toward the rule.
+		seen()                                // seen records that a line was read from the source.
+		restore(firing map[string]alertEvent) // restore resumes the rule firing if its last transition triggered.
+	}
+
+	// rules is a set of alert rules, each evaluated independently.
+	rules []rule
+)
+
+const (
+	stateInactive  alertState = iota // stateInactive is a rule that isn't alerting.
+	statePending                     // statePending is a rule that crossed its threshold, but not for long enough.
+	stateFiring                      // stateFiring is a rule that is alerting.
+	stateResolving                   // stateResolving is a firing rule that recovered, but not for long enough.
+)
 
-// newSaturationMonitor returns a pointer to a new satMon.
-// todo: use functional options, set above vars as defaults inside this function
+// newSaturationMonitor returns a pointer to a new satMon. It defaults to the high traffic rule
+// (-t requests per second averaged over -d seconds).
 func newSaturationMonitor(opts ...func(*satMon)) *satMon {
 	s := &satMon{
 		count:     0,
-		threshold: int64(psLimit * duration),
+		threshold: float64(psLimit * duration),
 		ttl:       time.Second * time.Duration(duration),
+		name:      "High traffic",
+		metric:    "hits",
+		op:        ">=",
+		recovery:  recoverLimit * float64(duration),
+		pendFor:   alertFor,
+		resFor:    alertFor,
+	}
+
+	for i := range opts {
+		opts[i](s)
+	}
+
+	return s
+}
+
+// newErrorMonitor returns a pointer to a new satMon for the high error rate rule (the -e fraction of
+// responses being errors over -d seconds).
+func newErrorMonitor(opts ...func(*satMon)) *satMon {
+	s := newSaturationMonitor(func(s *satMon) {
+		s.name = "High error rate"
+		s.metric = "errorRatio"
+		s.threshold = errRatio
+		s.recovery = 0
+		s.minTotal = int64(errMin)
+		s.with4xx = errWith4xx
+	})
+
+	for i := range opts {
+		opts[i](s)
 	}
 
+	return s
+}
+
+// newLowTrafficMonitor returns a pointer to a new satMon for the low traffic rule (fewer than -low
+// requests per second averaged over -d seconds).
+func newLowTrafficMonitor(opts ...func(*satMon)) *satMon {
+	s := newSaturationMonitor(func(s *satMon) {
+		s.name = "Low traffic"
+		s.op = "<"
+		s.threshold = lowLimit * float64(duration)
+		s.recovery = 0
+	})
+
 	for i := range opts {
 		opts[i](s)
 	}
@@ -30,6 +116,128 @@ func newSaturationMonitor(opts ...func(*satMon)) *satMon {
 	return s
 }
 
+// newIdleMonitor returns a pointer to a new satMon for the no traffic rule (no lines read from the
+// source for -idle seconds).
+func newIdleMonitor(opts ...func(*satMon)) *satMon {
+	s := newSaturationMonitor(func(s *satMon) {
+		s.name = "No traffic"
+		s.metric = "idle"
+		s.threshold = float64(idleLimit)
+		s.recovery = 0
+	})
+
+	for i := range opts {
+		opts[i](s)
+	}
+
+	return s
+}
+
+// parseRule builds a satMon from a comma separated list of key=value settings: name, metric,
+// window, op, threshold, recover, for, recoverFor, section, status, country, bots, min, and with4xx. Unset keys
+// keep the defaults of the high traffic rule. A threshold (or recover) ending in "/s" is per
+// second, and is multiplied by the window. Latency metrics (p50, p90, p99, max) compare milliseconds,
+// or a duration like 500ms.
+// example: name=login,section=/login,window=1m,threshold=50/s,recover=40/s,for=30s
+func parseRule(spec string) (*satMon, error) {
+	s := newSaturationMonitor(func(s *satMon) { s.recovery = 0 })
+	perSecond, recPerSecond := false, false
+	for _, kv := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Bad rule setting %q", kv)
+		}
+		k, v := parts[0], parts[1]
+		switch k {
+		case "name":
+			s.name = v
+		case "metric":
+			if v != "hits" && v != "bytes" && v != "5xx" && v != "errorRatio" && v != "idle" && !isLatencyMetric(v) {
+				return nil, fmt.Errorf("Unknown metric %q", v)
+			}
+			s.metric = v
+		case "window":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Second {
+				return nil, fmt.Errorf("Bad window %q", v)
+			}
+			s.ttl = d
+		case "op":
+			if v != ">=" && v != ">" && v != "<=" && v != "<" {
+				return nil, fmt.Errorf("Unknown op %q", v)
+			}
+			s.op = v
+		case "threshold":
+			if strings.HasSuffix(v, "/s") {
+				perSecond = true
+				v = strings.TrimSuffix(v, "/s")
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if d, derr := time.ParseDuration(v); err != nil && derr == nil {
+				// latency thresholds may be durations
+				f, err = millis(d), nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Bad threshold %q", v)
+			}
+			s.threshold = f
+		case "recover":
+			if strings.HasSuffix(v, "/s") {
+				recPerSecond = true
+				v = strings.TrimSuffix(v, "/s")
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f <= 0 {
+				return nil, fmt.Errorf("Bad recover %q", v)
+			}
+			s.recovery = f
+		case "for", "recoverFor":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("Bad %s %q", k, v)
+			}
+			if k == "for" {
+				s.pendFor, s.resFor = d, d
+			} else {
+				s.resFor = d
+			}
+		case "section":
+			s.section = "/" + strings.Trim(v, "/")
+		case "status":
+			s.status = v
+		case "country":
+			s.country = strings.ToUpper(v)
+		case "bots":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("Bad bots %q", v)
+			}
+			s.noBots = !b
+		case "min":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Bad min %q", v)
+			}
+			s.minTotal = n
+		case "with4xx":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("Bad with4xx %q", v)
+			}
+			s.with4xx = b
+		default:
+			return nil, fmt.Errorf("Unknown rule setting %q", k)
+		}
+	}
+	if perSecond {
+		s.threshold *= s.ttl.Seconds()
+	}
+	if recPerSecond {
+		s.recovery *= s.ttl.Seconds()
+	}
+	return s, nil
+}
+
 // push adds 1 to a satMon's counter and calls for it to be subtracted at ttl.
 func (r *satMon) push(ttl ...time.Duration) {
 	var t time.Duration
@@ -39,32 +247,230 @@ func (r *satMon) push(ttl ...time.Duration) {
 		// use the first element
 		t = ttl[0]
 	}
-	atomic.AddInt64(&r.count, 1)
-	go r.pop(t)
+	r.add(1, 0, t)
+}
+
+// add adds to a satMon's counter and total and calls for them to be subtracted at ttl.
+func (r *satMon) add(count, total int64, ttl time.Duration) {
+	atomic.AddInt64(&r.count, count)
+	atomic.AddInt64(&r.total, total)
+	go r.pop(count, total, ttl)
 }
 
-// pop subtracts 1 to a satMon's counter at ttl.
-func (r *satMon) pop(ttl time.Duration) {
+// pop subtracts from a satMon's counter and total at ttl.
+func (r *satMon) pop(count, total int64, ttl time.Duration) {
 	// todo: add total to be popped and do at once, would need to track their pop "time"
 	<-time.After(ttl)
-	if atomic.LoadInt64(&r.count) > 0 {
-		atomic.AddInt64(&r.count, -1)
+	if atomic.LoadInt64(&r.count) >= count {
+		atomic.AddInt64(&r.count, -count)
+	}
+	if atomic.LoadInt64(&r.total) >= total {
+		atomic.AddInt64(&r.total, -total)
+	}
+}
+
+// seen records that a line was read from the source, parseable or not.
+func (r *satMon) seen() {
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
+}
+
+// matches returns true if an entry passes the rule's section, status, country, and bot filters.
+func (r *satMon) matches(e logEntry) bool {
+	return (r.section == "" || sectionOf(e.request.path) == r.section) &&
+		(r.status == "" || matchStatus(r.status, strconv.Itoa(e.respCode))) &&
+		(r.country == "" || e.country == r.country) &&
+		(!r.noBots || !e.bot())
+}
+
+// observe counts an entry toward the rule if it matches the rule's filters.
+func (r *satMon) observe(e logEntry) {
+	if !r.matches(e) {
+		return
+	}
+	switch r.metric {
+	case "bytes":
+		if e.txBytes > 0 {
+			r.add(int64(e.txBytes), 0, r.ttl)
+		}
+	case "5xx":
+		if e.respCode >= 500 {
+			r.push()
+		}
+	case "errorRatio":
+		var errs int64
+		if e.respCode >= 500 || (r.with4xx && e.respCode >= 400) {
+			errs = 1
+		}
+		r.add(errs, 1, r.ttl)
+	case "idle":
+		// idle is measured from seen, not counted
+	default:
+		r.push()
+	}
+}
+
+// value returns the rule's current measurement.
+func (r *satMon) value() float64 {
+	if r.metric == "idle" {
+		since := atomic.LoadInt64(&r.last)
+		if started := atomic.LoadInt64(&r.started); started > since {
+			since = started
+		}
+		if since == 0 {
+			return 0
+		}
+		return time.Since(time.Unix(0, since)).Seconds()
+	}
+	count := atomic.LoadInt64(&r.count)
+	if r.metric != "errorRatio" {
+		return float64(count)
+	}
+	total := atomic.LoadInt64(&r.total)
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
+
+// exceeded returns true if v crosses the rule's threshold.
+func (r *satMon) exceeded(v float64) bool {
+	return !r.guarded() && r.compare(v, r.threshold)
+}
+
+// recovered returns true if v is back over the rule's recovery threshold (which defaults to the
+// threshold itself, and otherwise gives the alert some hysteresis). A restored rule doesn't recover
+// during its first window, since its value is only partly known.
+func (r *satMon) recovered(v float64) bool {
+	if r.restored && r.warming() {
+		return false
+	}
+	recovery := r.recovery
+	if recovery == 0 {
+		recovery = r.threshold
+	}
+	return r.guarded() || !r.compare(v, recovery)
+}
+
+// guarded returns true if the rule shouldn't be alerting regardless of its value. Ratios are
+// guarded while the window has fewer than minTotal requests, so a couple of errors at low traffic
+// aren't alarming. Below threshold rules are guarded during the first window, since it isn't full
+// yet.
+func (r *satMon) guarded() bool {
+	if r.metric == "errorRatio" && atomic.LoadInt64(&r.total) < r.minTotal {
+		return true
+	}
+	return (r.op == "<" || r.op == "<=") && r.warming()
+}
+
+// compare compares v to a threshold using the rule's op.
+func (r *satMon) compare(v, threshold float64) bool {
+	switch r.op {
+	case ">":
+		return v > threshold
+	case "<=":
+		return v <= threshold
+	case "<":
+		return v < threshold
 	}
+	return v >= threshold
 }
 
-// monitor watches a satMon's count, alerting if it exceeds the threshold.
+// warming returns true if the rule has been monitored for less than its window.
+func (r *satMon) warming() bool {
+	started := atomic.LoadInt64(&r.started)
+	return started != 0 && time.Since(time.Unix(0, started)) < r.ttl
+}
+
+// String allows alertState to implement the fmt.Stringer interface.
+func (s alertState) String() string {
+	switch s {
+	case statePending:
+		return "pending"
+	case stateFiring:
+		return "firing"
+	case stateResolving:
+		return "resolving"
+	}
+	return "inactive"
+}
+
+// event returns an alert transition for the rule. High traffic alerts over all sections name the
+// heaviest clients.
+func (r *satMon) event(triggered bool, v float64) alertEvent {
+	e := alertEvent{
+		Rule:      r.name,
+		Metric:    r.metric,
+		Section:   r.section,
+		Country:   r.country,
+		Triggered: triggered,
+		Value:     v,
+		Op:        r.op,
+		Threshold: r.threshold,
+		Time:      time.Now(),
+	}
+	if triggered && contributors != nil && r.section == "" && r.country == "" && (r.metric == "hits" || r.metric == "bytes") && (r.op == ">=" || r.op == ">") {
+		e.Top = contributors.top(topClients, r.metric)
+	}
+	return e
+}
+
+// step moves the rule through its alert lifecycle given its value v at now. It returns the alert
+// transition, if the rule started or stopped firing.
+func (r *satMon) step(now time.Time, v float64) *alertEvent {
+	switch r.state {
+	case stateInactive:
+		if !r.exceeded(v) {
+			return nil
+		}
+		r.state, r.since = statePending, now
+		return r.step(now, v)
+	case statePending:
+		if !r.exceeded(v) {
+			r.state, r.since = stateInactive, now
+			return nil
+		}
+		if now.Sub(r.since) < r.pendFor {
+			return nil
+		}
+		r.state, r.since = stateFiring, now
+		e := r.event(true, v)
+		return &e
+	case stateFiring:
+		if !r.recovered(v) {
+			return nil
+		}
+		r.state, r.since = stateResolving, now
+		return r.step(now, v)
+	case stateResolving:
+		if !r.recovered(v) {
+			r.state, r.since = stateFiring, now
+			return nil
+		}
+		if now.Sub(r.since) < r.resFor {
+			return nil
+		}
+		r.state, r.since = stateInactive, now
+		e := r.event(false, v)
+		return &e
+	}
+	return nil
+}
+
+// restore allows satMon to implement the rule interface.
+func (r *satMon) restore(firing map[string]alertEvent) {
+	if a, ok := firing[r.name]; ok {
+		r.state, r.since, r.restored = stateFiring, a.Time, true
+	}
+}
+
+// monitor watches a satMon's value, alerting when it fires and when it resolves.
 func (r *satMon) monitor(ctx context.Context) {
-	triggered := false
+	atomic.StoreInt64(&r.started, time.Now().UnixNano())
 	for {
 		select {
 		default:
-			if triggered && atomic.LoadInt64(&r.count) < r.threshold {
-				fmt.Printf("High traffic recovered at %s\n", time.Now().Format("15:04:05.1234"))
-				triggered = false
-			}
-			if !triggered && atomic.LoadInt64(&r.count) >= r.threshold {
-				fmt.Printf("High traffic generated an alert - hits = %d, triggered at %s\n", atomic.LoadInt64(&r.count), time.Now().Format("15:04:05.1234"))
-				triggered = true
+			if e := r.step(time.Now(), r.value()); e != nil {
+				outputs.alert(*e)
 			}
 
 			<-time.After(time.Second)
@@ -73,3 +479,51 @@ func (r *satMon) monitor(ctx context.Context) {
 		}
 	}
 }
+
+// monitor starts monitoring every rule.
+func (rs rules) monitor(ctx context.Context) {
+	for i := range rs {
+		go rs[i].monitor(ctx)
+	}
+}
+
+// seen records that a line was read from the source for every rule.
+func (rs rules) seen() {
+	for i := range rs {
+		rs[i].seen()
+	}
+}
+
+// restore resumes every rule whose last transition triggered.
+func (rs rules) restore(firing map[string]alertEvent) {
+	for i := range rs {
+		rs[i].restore(firing)
+	}
+}
+
+// names returns the names of the resumable alerts the rules raise, which restore matches on.
+func (rs rules) names() []string {
+	var out []string
+	for i := range rs {
+		switch r := rs[i].(type) {
+		case *satMon:
+			out = append(out, r.name)
+		case *latencyMon:
+			out = append(out, r.alert.name)
+		case *anomalyMon:
+			out = append(out, r.alert.name)
+		case *sloMon:
+			for _, b := range r.burns {
+				out = append(out, b.alert.name)
+			}
+		}
+	}
+	return out
+}
+
+// observe counts an entry toward every rule it matches.
+func (rs rules) observe(e logEntry) {
+	for i := range rs {
+		rs[i].observe(e)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sectionMon watches every section for traffic over a threshold, naming the offending section in
+// its alerts. To bound memory, only the busiest sections are tracked.
+type sectionMon struct {
+	threshold float64            // threshold is the hits within the window any one section may have.
+	limit     int                // limit is how many sections are tracked at once.
+	skip      map[string]bool    // skip are sections with their own thresholds, which this ignores.
+	mons      map[string]*satMon // mons are the tracked sections' rules.
+	tex       *sync.Mutex        // tex is mons' lock. It is also held while stepping the rules.
+}
+
+// newSectionMonitor returns a pointer to a new sectionMon that alerts on any section with more than
+// -section-limit requests per second averaged over -d seconds, tracking the -section-top busiest.
+// Sections in skip are ignored.
+func newSectionMonitor(skip map[string]bool) *sectionMon {
+	return &sectionMon{
+		threshold: sectionLimit * float64(duration),
+		limit:     sectionTop,
+		skip:      skip,
+		mons:      map[string]*satMon{},
+		tex:       &sync.Mutex{},
+	}
+}
+
+// parseSectionLimit builds a satMon from a "section=requests per second" setting, averaged over -d
+// seconds.
+func parseSectionLimit(spec string) (*satMon, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Bad section limit %q", spec)
+	}
+	limit, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("Bad section limit %q", parts[1])
+	}
+	return newSectionRule("/"+strings.Trim(parts[0], "/"), limit*float64(duration)), nil
+}
+
+// newSectionRule returns a pointer to a new high traffic satMon limited to section.
+func newSectionRule(section string, threshold float64) *satMon {
+	return newSaturationMonitor(func(s *satMon) {
+		s.name = "High traffic on " + section
+		s.section = section
+		s.threshold = threshold
+		s.recovery = 0
+	})
+}
+
+// observe allows sectionMon to implement the rule interface. A section that isn't tracked yet
+// replaces the quietest tracked section that isn't alerting, if there's no room for it.
+func (sm *sectionMon) observe(e logEntry) {
+	section := sectionOf(e.request.path)
+	if sm.skip[section] {
+		return
+	}
+
+	sm.tex.Lock()
+	m, ok := sm.mons[section]
+	if !ok {
+		if len(sm.mons) >= sm.limit && !sm.evict() {
+			sm.tex.Unlock()
+			return
+		}
+		m = newSectionRule(section, sm.threshold)
+		m.started = time.Now().UnixNano()
+		sm.mons[section] = m
+	}
+	sm.tex.Unlock()
+
+	m.observe(e)
+}
+
+// evict stops tracking the quietest inactive section. It returns false if every section is
+// alerting. sm.tex must be held.
+func (sm *sectionMon) evict() bool {
+	quietest := ""
+	var low float64
+	for section, m := range sm.mons {
+		if m.state != stateInactive {
+			continue
+		}
+		if v := m.value(); quietest == "" || v < low {
+			quietest, low = section, v
+		}
+	}
+	if quietest == "" {
+		return false
+	}
+	delete(sm.mons, quietest)
+	return true
+}
+
+// seen allows sectionMon to implement the rule interface.
+func (sm *sectionMon) seen() {}
+
+// restore allows sectionMon to implement the rule interface. Firing sections are tracked again, as
+// far as there's room.
+func (sm *sectionMon) restore(firing map[string]alertEvent) {
+	sm.tex.Lock()
+	defer sm.tex.Unlock()
+	for _, a := range firing {
+		if a.Section == "" || a.Rule != "High traffic on "+a.Section || sm.skip[a.Section] || len(sm.mons) >= sm.limit {
+			continue
+		}
+		m := newSectionRule(a.Section, sm.threshold)
+		m.started = time.Now().UnixNano()
+		m.restore(firing)
+		sm.mons[a.Section] = m
+	}
+}
+
+// monitor allows sectionMon to implement the rule interface.
+func (sm *sectionMon) monitor(ctx context.Context) {
+	for {
+		select {
+		default:
+			sm.tex.Lock()
+			now := time.Now()
+			for _, m := range sm.mons {
+				if e := m.step(now, m.value()); e != nil {
+					outputs.alert(*e)
+				}
+			}
+			sm.tex.Unlock()
+
+			<-time.After(time.Second)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// secMon watches each client for attacks: many distinct 404s (path scanning), repeated 401 and
+	// 403 responses on auth paths (credential stuffing), and requests matching SQL injection, XSS, or
+	// path traversal signatures. Detectors alert per client, naming its remote host, and recover once
+	// the client has been quiet for the window.
+	secMon struct {
+		window    time.Duration // window is how long suspicious requests count toward an alert.
+		detectors []*detector   // detectors are the enabled attack detectors.
+		tex       *sync.Mutex   // tex is the detectors' clients' lock.
+	}
+
+	// detector counts one kind of suspicious request per client.
+	detector struct {
+		name      string                 // name is the rule name alerts have, e.g. "Path scanning".
+		metric    string                 // metric is what the detector counts.
+		threshold int                    // threshold is how many suspicious requests in the window fire an alert.
+		distinct  bool                   // distinct is whether only requests for distinct paths count.
+		match     func(logEntry) bool    // match returns true if a request is suspicious.
+		clients   map[string]*suspectLog // clients are the clients with suspicious requests in the window, by address.
+	}
+
+	// suspectLog is a client's suspicious requests within the window.
+	suspectLog struct {
+		hits   []suspectHit // hits are the suspicious requests, oldest first.
+		firing bool         // firing is true if the detector alerted on the client.
+	}
+
+	// suspectHit is a suspicious request.
+	suspectHit struct {
+		at   time.Time // at is when the request was seen.
+		path string    // path is the requested resource.
+	}
+)
+
+const (
+	// suspectClients is how many clients a detector tracks at once. Others are ignored until some
+	// quiet down.
+	suspectClients = 10000
+	// suspectHits is how many suspicious requests a detector keeps per client.
+	suspectHits = 1000
+	// suspectPathLen is how much of the last suspicious path alerts show.
+	suspectPathLen = 120
+)
+
+var (
+	// sqliPattern matches common SQL injection probes.
+	sqliPattern = regexp.MustCompile(`(?i)union(\s|/\*.*?\*/)+(all\s+)?select\b|\bor\s+['"]?\d+['"]?\s*=\s*['"]?\d+|'\s*or\s+'|\b(sleep|benchmark|pg_sleep|load_file|extractvalue|updatexml)\s*\(|waitfor\s+delay|information_schema|;\s*(drop|delete|insert|update|shutdown)\s`)
+	// xssPattern matches common cross-site scripting probes.
+	xssPattern = regexp.MustCompile(`(?i)<\s*/?\s*(script|iframe|svg|img|body|object|embed)\b|javascript\s*:|\bon(error|load|mouseover|focus|click)\s*=|document\.(cookie|domain|location)|\b(alert|prompt|confirm|eval)\s*\(`)
+	// traversalPattern matches path traversal and local file inclusion probes.
+	traversalPattern = regexp.MustCompile(`(?i)\.\.[/\\]|/etc/(passwd|shadow|hosts)|\b(win|boot|system)\.ini\b|/proc/self/|\b(php|file|expect)://`)
+)
+
+// newSecurityMonitor returns a pointer to a new secMon with the enabled detectors: -scan, -bruteforce
+// on -auth-paths, and -injection, counting over -security-window.
+func newSecurityMonitor(opts ...func(*secMon)) *secMon {
+	m := &secMon{
+		window: securityWindow,
+		tex:    &sync.Mutex{},
+	}
+	if scanLimit > 0 {
+		m.detectors = append(m.detectors, newDetector("Path scanning", "distinct404s", scanLimit, true, func(e logEntry) bool {
+			return e.respCode == 404
+		}))
+	}
+	if bruteLimit > 0 {
+		paths := authPaths(authPathSpec)
+		m.detectors = append(m.detectors, newDetector("Credential stuffing", "authFailures", bruteLimit, false, func(e logEntry) bool {
+			return (e.respCode == 401 || e.respCode == 403) && isAuthPath(e.request.path, paths)
+		}))
+	}
+	if injection {
+		for _, d := range []struct {
+			name    string
+			pattern *regexp.Regexp
+		}{{"SQL injection", sqliPattern}, {"Cross-site scripting", xssPattern}, {"Path traversal", traversalPattern}} {
+			pattern := d.pattern
+			m.detectors = append(m.detectors, newDetector(d.name, "signatures", 1, false, func(e logEntry) bool {
+				return pattern.MatchString(decodePath(e.request.path))
+			}))
+		}
+	}
+
+	for i := range opts {
+		opts[i](m)
+	}
+
+	return m
+}
+
+// newDetector returns a pointer to a new detector.
+func newDetector(name, metric string, threshold int, distinct bool, match func(logEntry) bool) *detector {
+	return &detector{
+		name:      name,
+		metric:    metric,
+		threshold: threshold,
+		distinct:  distinct,
+		match:     match,
+		clients:   map[string]*suspectLog{},
+	}
+}
+
+// authPaths returns the lowercased paths of a comma separated list, without trailing slashes.
+func authPaths(spec string) []string {
+	var out []string
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.TrimRight(strings.ToLower(strings.TrimSpace(p)), "/"); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// isAuthPath returns true if the path requested (ignoring any query) is one of paths or under one.
+func isAuthPath(p string, paths []string) bool {
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	p = strings.ToLower(p)
+	for _, a := range paths {
+		if p == a || strings.HasPrefix(p, a+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// decodePath returns a request path with up to two rounds of url decoding undone, so encoded and
+// double encoded probes match their signatures.
+func decodePath(p string) string {
+	for i := 0; i < 2; i++ {
+		d, err := url.QueryUnescape(p)
+		if err != nil || d == p {
+			break
+		}
+		p = d
+	}
+	return p
+}
+
+// observe allows secMon to implement the rule interface.
+func (m *secMon) observe(e logEntry) {
+	m.add(time.Now(), e)
+}
+
+// add counts an entry at now toward every detector that finds it suspicious.
+func (m *secMon) add(now time.Time, e logEntry) {
+	var client string
+	m.tex.Lock()
+	defer m.tex.Unlock()
+	for _, d := range m.detectors {
+		if !d.match(e) {
+			continue
+		}
+		if client == "" {
+			client = clientHost(e.remoteHost)
+		}
+		s, ok := d.clients[client]
+		if !ok {
+			if len(d.clients) >= suspectClients {
+				continue
+			}
+			s = &suspectLog{}
+			d.clients[client] = s
+		}
+		if len(s.hits) >= suspectHits {
+			s.hits = append(s.hits[:0], s.hits[1:]...)
+		}
+		s.hits = append(s.hits, suspectHit{at: now, path: e.request.path})
+	}
+}
+
+// seen allows secMon to implement the rule interface.
+func (m *secMon) seen() {}
+
+// restore allows secMon to implement the rule interface. Security alerts are per client, and start
+// over after a restart.
+func (m *secMon) restore(firing map[string]alertEvent) {}
+
+// monitor allows secMon to implement the rule interface.
+func (m *secMon) monitor(ctx context.Context) {
+	for {
+		select {
+		default:
+			for _, e := range m.step(time.Now()) {
+				outputs.alert(e)
+			}
+
+			<-time.After(time.Second)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// step forgets suspicious requests older than the window, returning an alert transition for every
+// client that reached or fell below a detector's threshold.
+func (m *secMon) step(now time.Time) []alertEvent {
+	var out []alertEvent
+	m.tex.Lock()
+	defer m.tex.Unlock()
+	for _, d := range m.detectors {
+		clients := make([]string, 0, len(d.clients))
+		for client := range d.clients {
+			clients = append(clients, client)
+		}
+		sort.Strings(clients)
+		for _, client := range clients {
+			s := d.clients[client]
+			i := 0
+			for i < len(s.hits) && now.Sub(s.hits[i].at) >= m.window {
+				i++
+			}
+			s.hits = s.hits[i:]
+			n := d.count(s)
+			switch {
+			case !s.firing && n >= d.threshold:
+				s.firing = true
+				out = append(out, d.event(true, client, s, n, now))
+			case s.firing && n < d.threshold:
+				s.firing = false
+				out = append(out, d.event(false, client, s, n, now))
+			}
+			if !s.firing && len(s.hits) == 0 {
+				delete(d.clients, client)
+			}
+		}
+	}
+	return out
+}
+
+// count returns how many of a client's suspicious requests count toward the threshold.
+func (d *detector) count(s *suspectLog) int {
+	if !d.distinct {
+		return len(s.hits)
+	}
+	paths := map[string]bool{}
+	for _, h := range s.hits {
+		paths[h.path] = true
+	}
+	return len(paths)
+}
+
+// event returns an alert transition for a client, naming the last suspicious path it requested when
+// triggered.
+func (d *detector) event(triggered bool, client string, s *suspectLog, n int, now time.Time) alertEvent {
+	e := alertEvent{
+		Rule:       d.name,
+		Metric:     d.metric,
+		RemoteHost: client,
+		Triggered:  triggered,
+		Value:      float64(n),
+		Op:         ">=",
+		Threshold:  float64(d.threshold),
+		Time:       now,
+	}
+	if triggered && len(s.hits) > 0 {
+		e.Path = truncate(s.hits[len(s.hits)-1].path, suspectPathLen)
+	}
+	return e
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// serve runs bver's http server on addr until ctx is done.
+func serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveDashboard)
+	mux.HandleFunc("/events", events.serveEvents)
+	mux.HandleFunc("/history", events.serveHistory)
+	mux.Handle("/silences", silences)
+	if metrics != nil {
+		mux.Handle("/metrics", metrics)
+	}
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		srv.Shutdown(shutCtx)
+	}()
+
+	fmt.Fprintf(console, "Serving dashboard on %s\n", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(console, "Failed to serve - %s\n", err.Error())
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// silence mutes notifications for matching alerts between Start and End. Matchers may use "*"
+	// as a wildcard; empty matchers match anything.
+	silence struct {
+		ID      string    `json:"id"`                // ID identifies the silence, e.g. for deleting it.
+		Rule    string    `json:"rule,omitempty"`    // Rule matches the alert's rule name.
+		Metric  string    `json:"metric,omitempty"`  // Metric matches the alert's metric.
+		Section string    `json:"section,omitempty"` // Section matches the alert's section.
+		Start   time.Time `json:"start"`             // Start is when the silence begins.
+		End     time.Time `json:"end"`               // End is when the silence expires.
+		Comment string    `json:"comment,omitempty"` // Comment says why, e.g. "load test".
+		source  string    // source is where the silence came from: flag, file, or api.
+	}
+
+	// silencer holds the silences. Expired silences are removed whenever it is used.
+	silencer struct {
+		list []silence   // list is the silences, in the order they were added.
+		next int         // next is the id of the next silence added.
+		tex  *sync.Mutex // tex is list's and next's lock.
+	}
+
+	// notifier wraps a sink that notifies people, so it skips silenced alerts.
+	notifier struct {
+		sink // sink is the wrapped notifier.
+	}
+)
+
+// silences are the configured silences.
+var silences = newSilencer()
+
+// newSilencer returns a pointer to a new silencer.
+func newSilencer() *silencer {
+	return &silencer{next: 1, tex: &sync.Mutex{}}
+}
+
+// parseSilence builds a silence from comma separated key=value settings: rule, metric, section,
+// start (RFC3339, default now), end (RFC3339) or for (a duration from start), and comment.
+func parseSilence(spec string, now time.Time) (silence, error) {
+	s := silence{Start: now}
+	var length time.Duration
+	for _, kv := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return s, fmt.Errorf("Bad silence setting %q", kv)
+		}
+		k, v := parts[0], parts[1]
+		var err error
+		switch k {
+		case "rule":
+			s.Rule = v
+		case "metric":
+			s.Metric = v
+		case "section":
+			s.Section = v
+		case "start":
+			s.Start, err = time.Parse(time.RFC3339, v)
+		case "end":
+			s.End, err = time.Parse(time.RFC3339, v)
+		case "for":
+			length, err = time.ParseDuration(v)
+		case "comment":
+			s.Comment = v
+		default:
+			return s, fmt.Errorf("Unknown silence setting %q", k)
+		}
+		if err != nil {
+			return s, fmt.Errorf("Bad %s %q", k, v)
+		}
+	}
+	if length > 0 {
+		s.End = s.Start.Add(length)
+	}
+	return s, nil
+}
+
+// add adds a silence, returning it with its id.
+func (sr *silencer) add(s silence, source string) (silence, error) {
+	if s.End.IsZero() || !s.End.After(s.Start) {
+		return s, fmt.Errorf("Silence must end after it starts")
+	}
+	sr.tex.Lock()
+	defer sr.tex.Unlock()
+	s.ID = strconv.Itoa(sr.next)
+	s.source = source
+	sr.next++
+	sr.list = append(sr.list, s)
+	return s, nil
+}
+
+// remove removes the silence with id, returning false if there isn't one.
+func (sr *silencer) remove(id string) bool {
+	sr.tex.Lock()
+	defer sr.tex.Unlock()
+	for i := range sr.list {
+		if sr.list[i].ID == id {
+			sr.list = append(sr.list[:i], sr.list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the silences that haven't expired, including those yet to start.
+func (sr *silencer) current(now time.Time) []silence {
+	sr.tex.Lock()
+	defer sr.tex.Unlock()
+	sr.expire(now)
+	return append([]silence{}, sr.list...)
+}
+
+// silenced returns true if an active silence matches the alert.
+func (sr *silencer) silenced(a alertEvent) bool {
+	sr.tex.Lock()
+	defer sr.tex.Unlock()
+	sr.expire(a.Time)
+	for i := range sr.list {
+		if sr.list[i].matches(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// expire removes silences that ended before now. sr.tex must be held.
+func (sr *silencer) expire(now time.Time) {
+	kept := sr.list[:0]
+	for i := range sr.list {
+		if sr.list[i].End.After(now) {
+			kept = append(kept, sr.list[i])
+		}
+	}
+	sr.list = kept
+}
+
+// load replaces the silences from the silence file with the file's current contents: one silence
+// per line, as for -silence, ignoring blank lines and "#" comments.
+func (sr *silencer) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	var loaded []silence
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, err := parseSilence(line, now)
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	sr.tex.Lock()
+	kept := sr.list[:0]
+	for i := range sr.list {
+		if sr.list[i].source != "file" {
+			kept = append(kept, sr.list[i])
+		}
+	}
+	sr.list = kept
+	sr.tex.Unlock()
+
+	for i := range loaded {
+		if _, err := sr.add(loaded[i], "file"); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping silence %+v - %s\n", loaded[i], err.Error())
+		}
+	}
+	return nil
+}
+
+// ServeHTTP allows silencer to implement the http.Handler interface. GET lists the silences, POST
+// adds one from a json silence, and DELETE removes the one given by the id query parameter.
+func (sr *silencer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sr.current(time.Now()))
+	case "POST":
+		s := silence{Start: time.Now()}
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, err := sr.add(s, "api")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	case "DELETE":
+		if !sr.remove(r.URL.Query().Get("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// matches returns true if the silence is active at the alert's time and matches it.
+func (s silence) matches(a alertEvent) bool {
+	return !a.Time.Before(s.Start) && a.Time.Before(s.End) &&
+		globMatch(s.Rule, a.Rule) && globMatch(s.Metric, a.Metric) && globMatch(s.Section, a.Section)
+}
+
+// globMatch returns true if s matches pattern, where "*" matches any run of characters. An empty
+// pattern matches anything.
+func globMatch(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	parts := strings.Split(pattern, "*")
+	last := len(parts) - 1
+	if last == 0 {
+		return s == pattern
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1:last] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[last])
+}
+
+// alert allows notifier to implement the sink interface, dropping silenced alerts.
+func (n notifier) alert(a alertEvent) {
+	if a.Silenced {
+		return
+	}
+	n.sink.alert(a)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// sink defines somewhere interval reports and alert transitions are sent.
+	sink interface {
+		report(s stats)     // report receives a snapshot of an interval's stats.
+		alert(a alertEvent) // alert receives an alert transition.
+	}
+
+	// alertEvent defines an alert transition.
+	alertEvent struct {
+		Rule       string        `json:"rule"`                 // Rule is the name of the rule that transitioned.
+		Metric     string        `json:"metric"`               // Metric is what the rule measures.
+		Section    string        `json:"section,omitempty"`    // Section is the section the rule is limited to, if any.
+		Country    string        `json:"country,omitempty"`    // Country is the country the rule is limited to, if any.
+		Triggered  bool          `json:"triggered"`            // Triggered is true if the alert fired, false if it recovered.
+		Value      float64       `json:"value"`                // Value is the measurement at the time of the transition.
+		Op         string        `json:"op"`                   // Op is how the value was compared to the threshold.
+		Threshold  float64       `json:"threshold"`            // Threshold is the limit the value was compared against.
+		Time       time.Time     `json:"time"`                 // Time is when the transition happened.
+		Expected   float64       `json:"expected,omitempty"`   // Expected is the baseline value, for anomaly rules.
+		StdDev     float64       `json:"stdDev,omitempty"`     // StdDev is the baseline's standard deviation, for anomaly rules.
+		Observed   float64       `json:"observed,omitempty"`   // Observed is the value compared to the baseline, for anomaly rules.
+		Silenced   bool          `json:"silenced,omitempty"`   // Silenced is true if a silence kept the transition from notifiers.
+		Top        []clientCount `json:"top,omitempty"`        // Top are the heaviest clients over the window, for high traffic alerts.
+		RemoteHost string        `json:"remoteHost,omitempty"` // RemoteHost is the offending client, for security alerts.
+		Path       string        `json:"path,omitempty"`       // Path is the client's last suspicious request, for security alerts.
+	}
+
+	// fanout sends reports and alerts to several sinks, each running independently.
+	fanout struct {
+		queues []*sinkQueue  // queues are the running sinks.
+		tex    *sync.RWMutex // tex is queues' lock.
+	}
+
+	// sinkQueue runs a sink in its own goroutine so a slow sink can't stall aggregation.
+	sinkQueue struct {
+		name     string        // name identifies the sink in warnings.
+		sink     sink          // sink is the wrapped sink.
+		queue    chan func()   // queue is the pending deliveries.
+		dropped  int64         // dropped is how many deliveries were dropped since the last warning.
+		lossless bool          // lossless is true if alerts wait for room rather than being dropped.
+		done     chan struct{} // done is closed when the queue stops.
+	}
+
+	// renderer defines a format reports and alerts can be written in.
+	renderer interface {
+		renderReport(w io.Writer, s stats) error     // renderReport writes a report.
+		renderAlert(w io.Writer, a alertEvent) error // renderAlert writes an alert transition.
+	}
+
+	// writerSink renders reports and alerts to a writer.
+	writerSink struct {
+		w   io.Writer   // w is where output is written.
+		r   renderer    // r is the format of the output.
+		tex *sync.Mutex // tex serializes writes.
+	}
+
+	// feedSink publishes reports and alerts to the live feed.
+	feedSink struct {
+		f *feed // f is the feed to publish to.
+	}
+
+	// textRenderer renders the human friendly console format.
+	textRenderer struct{}
+
+	// jsonRenderer renders one json object per line, matching the live feed's events.
+	jsonRenderer struct{}
+
+	// csvRenderer renders "time,kind,key,count" rows.
+	csvRenderer struct {
+		header bool // header is true once the header row was written.
+	}
+
+	// reopener defines a sink that can reopen its files, e.g. after logrotate moved them.
+	reopener interface {
+		reopen() error
+	}
+
+	// resetter defines a renderer with per-file state, reset whenever it starts writing a file.
+	resetter interface {
+		reset(empty bool) // reset is told whether the file is empty.
+	}
+)
+
+// queueSize is how many deliveries may wait for a sink before new ones are dropped.
+const queueSize = 16
+
+// outputs is where reports and alerts are sent.
+var outputs = newFanout()
+
+// newFanout returns a pointer to a new fanout with no sinks.
+func newFanout() *fanout {
+	return &fanout{tex: &sync.RWMutex{}}
+}
+
+// add starts running a sink and adds it to the fanout.
+func (f *fanout) add(name string, s sink) {
+	f.start(name, s, false)
+}
+
+// addLossless starts running a sink that must see every alert transition, e.g. the journal, and adds
+// it to the fanout. Alerts wait for the sink to catch up rather than being dropped.
+func (f *fanout) addLossless(name string, s sink) {
+	f.start(name, s, true)
+}
+
+// start starts running a sink and adds it to the fanout.
+func (f *fanout) start(name string, s sink, lossless bool) {
+	q := &sinkQueue{
+		name:     name,
+		sink:     s,
+		queue:    make(chan func(), queueSize),
+		done:     make(chan struct{}),
+		lossless: lossless,
+	}
+	go q.run()
+	f.tex.Lock()
+	f.queues = append(f.queues, q)
+	f.tex.Unlock()
+}
+
+// close stops every sink once its pending deliveries are done.
+func (f *fanout) close() {
+	f.tex.Lock()
+	defer f.tex.Unlock()
+	for i := range f.queues {
+		close(f.queues[i].queue)
+		<-f.queues[i].done
+	}
+	f.queues = nil
+}
+
+// reopen asks every sink that can to reopen its files. It is queued behind pending deliveries so it
+// doesn't race with writes, but waits for room rather than being dropped when a sink is behind.
+func (f *fanout) reopen() {
+	f.tex.RLock()
+	defer f.tex.RUnlock()
+	for i := range f.queues {
+		q := f.queues[i]
+		q.queue <- func() {
+			if r, ok := q.sink.(reopener); ok {
+				if err := r.reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reopen output - %s\n", err.Error())
+				}
+			}
+		}
+	}
+}
+
+// report allows fanout to implement the sink interface.
+func (f *fanout) report(s stats) {
+	f.deliver(func(sk sink) { sk.report(s) })
+}
+
+// alert allows fanout to implement the sink interface. The alert is marked if it is silenced.
+func (f *fanout) alert(a alertEvent) {
+	a.Silenced = silences.silenced(a)
+	f.send(func(sk sink) { sk.alert(a) }, true)
+}
+
+// deliver queues fn for every sink, dropping it for sinks that are full.
+func (f *fanout) deliver(fn func(sink)) {
+	f.send(fn, false)
+}
+
+// send queues fn for every sink. It waits for room in lossless sinks' queues if wait is true, and is
+// dropped for other sinks that are full.
+func (f *fanout) send(fn func(sink), wait bool) {
+	f.tex.RLock()
+	defer f.tex.RUnlock()
+	for i := range f.queues {
+		q := f.queues[i]
+		if wait && q.lossless {
+			q.queue <- func() { fn(q.sink) }
+			continue
+		}
+		select {
+		case q.queue <- func() { fn(q.sink) }:
+		default:
+			atomic.AddInt64(&q.dropped, 1)
+		}
+	}
+}
+
+// run delivers queued items until the queue is closed.
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	for fn := range q.queue {
+		fn()
+		if n := atomic.SwapInt64(&q.dropped, 0); n > 0 {
+			fmt.Fprintf(os.Stderr, "Output %s fell behind, dropped %d events\n", q.name, n)
+		}
+	}
+}
+
+// newWriterSink returns a pointer to a new writerSink.
+func newWriterSink(w io.Writer, r renderer) *writerSink {
+	return &writerSink{w: w, r: r, tex: &sync.Mutex{}}
+}
+
+// report allows writerSink to implement the sink interface.
+func (ws *writerSink) report(s stats) {
+	ws.tex.Lock()
+	defer ws.tex.Unlock()
+	ws.rotate()
+	if err := ws.r.renderReport(ws.w, s); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write report - %s\n", err.Error())
+	}
+}
+
+// alert allows writerSink to implement the sink interface.
+func (ws *writerSink) alert(a alertEvent) {
+	ws.tex.Lock()
+	defer ws.tex.Unlock()
+	ws.rotate()
+	if err := ws.r.renderAlert(ws.w, a); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write alert - %s\n", err.Error())
+	}
+}
+
+// rotate rotates the writer first if it is a rotatingFile that is due. ws.tex must be held.
+func (ws *writerSink) rotate() {
+	f, ok := ws.w.(*rotatingFile)
+	if !ok || !f.due() {
+		return
+	}
+	if err := f.rotate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to rotate output - %s\n", err.Error())
+	}
+	ws.restart(f)
+}
+
+// reopen allows writerSink to implement the reopener interface. It does nothing unless the writer
+// is a rotatingFile.
+func (ws *writerSink) reopen() error {
+	ws.tex.Lock()
+	defer ws.tex.Unlock()
+	f, ok := ws.w.(*rotatingFile)
+	if !ok {
+		return nil
+	}
+	if err := f.reopen(); err != nil {
+		return err
+	}
+	ws.restart(f)
+	return nil
+}
+
+// restart resets the renderer for the file it is now writing. ws.tex must be held.
+func (ws *writerSink) restart(f *rotatingFile) {
+	if r, ok := ws.r.(resetter); ok {
+		r.reset(f.empty())
+	}
+}
+
+// message returns the alert as a console message.
+func (a alertEvent) message() string {
+	if a.Triggered && a.Metric == "anomaly" {
+		return fmt.Sprintf("%s generated an alert - hits = %.0f, expected %.0f ± %.0f, triggered at %s", a.Rule, a.Observed, a.Expected, a.StdDev, a.Time.Format("15:04:05.1234"))
+	}
+	if a.Triggered && a.RemoteHost != "" {
+		return fmt.Sprintf("%s generated an alert - %s = %s, triggered at %s, last %s", a.subject(), a.Metric, a.formatValue(), a.Time.Format("15:04:05.1234"), a.Path)
+	}
+	if a.Triggered && len(a.Top) > 0 {
+		return fmt.Sprintf("%s generated an alert - %s = %s, triggered at %s, top clients %s", a.Rule, a.Metric, a.formatValue(), a.Time.Format("15:04:05.1234"), formatClients(a.Top, a.Metric))
+	}
+	if a.Triggered {
+		return fmt.Sprintf("%s generated an alert - %s = %s, triggered at %s", a.Rule, a.Metric, a.formatValue(), a.Time.Format("15:04:05.1234"))
+	}
+	return fmt.Sprintf("%s recovered at %s", a.subject(), a.Time.Format("15:04:05.1234"))
+}
+
+// subject returns the alert's rule, and for security alerts, the offending client.
+// example: "Path scanning from 203.0.113.9"
+func (a alertEvent) subject() string {
+	if a.RemoteHost == "" {
+		return a.Rule
+	}
+	return a.Rule + " from " + a.RemoteHost
+}
+
+// formatValue returns the alert's value, as a whole number unless it is a ratio.
+func (a alertEvent) formatValue() string {
+	if a.Metric == "errorRatio" || a.Metric == "anomaly" || a.Metric == "burnRate" || isLatencyMetric(a.Metric) {
+		return strconv.FormatFloat(a.Value, 'f', 3, 64)
+	}
+	return strconv.FormatFloat(a.Value, 'f', 0, 64)
+}
+
+// report allows feedSink to implement the sink interface.
+func (fs feedSink) report(s stats) {
+	fs.f.publish(event{Kind: "report", Time: s.end, Data: s})
+}
+
+// alert allows feedSink to implement the sink interface.
+func (fs feedSink) alert(a alertEvent) {
+	fs.f.publishAlert(a)
+}
+
+// renderReport allows textRenderer to implement the renderer interface.
+func (textRenderer) renderReport(w io.Writer, s stats) error {
+	return s.print(w)
+}
+
+// renderAlert allows textRenderer to implement the renderer interface.
+func (textRenderer) renderAlert(w io.Writer, a alertEvent) error {
+	_, err := fmt.Fprintln(w, a.message())
+	return err
+}
+
+// renderReport allows jsonRenderer to implement the renderer interface.
+func (jsonRenderer) renderReport(w io.Writer, s stats) error {
+	return json.NewEncoder(w).Encode(event{Kind: "report", Time: s.end, Data: s})
+}
+
+// renderAlert allows jsonRenderer to implement the renderer interface.
+func (jsonRenderer) renderAlert(w io.Writer, a alertEvent) error {
+	return json.NewEncoder(w).Encode(event{Kind: "alert", Time: a.Time, Data: a})
+}
+
+// renderReport allows csvRenderer to implement the renderer interface.
+func (c *csvRenderer) renderReport(w io.Writer, s stats) error {
+	t := s.end.Format(time.RFC3339)
+	rows := [][]string{}
+	for i := range s.requests {
+		rows = append(rows, []string{t, "request", s.requests[i].section, strconv.Itoa(s.requests[i].count)})
+		if s.requests[i].hotlinked() {
+			rows = append(rows, []string{t, "hotlinked", s.requests[i].section, strconv.Itoa(s.requests[i].hotlinks)})
+		}
+	}
+	for i := range s.responses {
+		rows = append(rows, []string{t, "response", strconv.Itoa(s.responses[i].code), strconv.Itoa(s.responses[i].count)})
+	}
+	rows = append(rows, []string{t, "txbytes", "", strconv.Itoa(s.txBytes)})
+	counts := s.visitorCounts()
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		rows = append(rows, []string{t, "visitors", key, strconv.FormatInt(counts[key].Estimate, 10)})
+		rows = append(rows, []string{t, "visitors_error", key, strconv.FormatInt(counts[key].Error, 10)})
+	}
+	if s.windowVisitors != nil {
+		key := fmt.Sprintf("last %ds", s.windowSeconds)
+		rows = append(rows, []string{t, "visitors", key, strconv.FormatInt(s.windowVisitors.Estimate, 10)})
+		rows = append(rows, []string{t, "visitors_error", key, strconv.FormatInt(s.windowVisitors.Error, 10)})
+	}
+	sums := s.latencySummaries()
+	keys = make([]string, 0, len(sums))
+	for key := range sums {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		l := sums[key]
+		for _, q := range []struct {
+			kind string
+			ms   float64
+		}{{"latency_p50", l.P50}, {"latency_p90", l.P90}, {"latency_p99", l.P99}, {"latency_max", l.Max}} {
+			rows = append(rows, []string{t, q.kind, key, strconv.FormatFloat(q.ms, 'f', 3, 64)})
+		}
+	}
+	for _, c := range s.topCountries {
+		rows = append(rows, []string{t, "country", c.Key, strconv.Itoa(c.Count)})
+	}
+	for _, c := range s.topNetworks {
+		rows = append(rows, []string{t, "asn", c.Key, strconv.Itoa(c.Count)})
+	}
+	if len(siteHosts) > 0 {
+		rows = append(rows, []string{t, "referer_same_site", "", strconv.Itoa(s.sameSite)})
+		rows = append(rows, []string{t, "referer_external", "", strconv.Itoa(s.external)})
+	}
+	for _, c := range s.topReferers {
+		rows = append(rows, []string{t, "referer", c.Key, strconv.Itoa(c.Count)})
+	}
+	for _, c := range s.topAgents {
+		rows = append(rows, []string{t, "agent", c.Key, strconv.Itoa(c.Count)})
+	}
+	for _, c := range s.topClients {
+		rows = append(rows, []string{t, "client", c.Client, strconv.FormatInt(c.Hits, 10)})
+		rows = append(rows, []string{t, "client_bytes", c.Client, strconv.FormatInt(c.Bytes, 10)})
+	}
+	if s.slo != nil {
+		rows = append(rows, []string{t, "slo", "budgetRemaining", strconv.FormatFloat(s.slo.Remaining, 'f', 4, 64)})
+	}
+	return c.write(w, rows)
+}
+
+// renderAlert allows csvRenderer to implement the renderer interface.
+func (c *csvRenderer) renderAlert(w io.Writer, a alertEvent) error {
+	key := "recovered"
+	if a.Triggered {
+		key = "triggered"
+	}
+	return c.write(w, [][]string{{a.Time.Format(time.RFC3339), "alert", a.subject() + " " + key, a.formatValue()}})
+}
+
+// reset allows csvRenderer to implement the resetter interface. Only empty files get a header.
+func (c *csvRenderer) reset(empty bool) {
+	c.header = !empty
+}
+
+// write writes rows, preceded by the header row the first time.
+func (c *csvRenderer) write(w io.Writer, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	if !c.header {
+		cw.Write([]string{"time", "kind", "key", "count"})
+		c.header = true
+	}
+	cw.WriteAll(rows)
+	return cw.Error()
+}
+
+// newRenderer returns the renderer for a format name.
+func newRenderer(format string) (renderer, error) {
+	switch format {
+	case "text":
+		return textRenderer{}, nil
+	case "json":
+		return jsonRenderer{}, nil
+	case "csv":
+		return &csvRenderer{}, nil
+	}
+	return nil, fmt.Errorf("Unknown output format %q", format)
+}
+
+// newSink builds a sink from a "format[:destination]" output spec. Destination is "stdout"
+// (default), "stderr", or a file path to append to, rotated as configured by the -rotate flags.
+func newSink(spec string) (sink, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	format, dest := parts[0], "stdout"
+	if len(parts) == 2 && parts[1] != "" {
+		dest = parts[1]
+	}
+
+	r, err := newRenderer(format)
+	if err != nil {
+		return nil, err
+	}
+
+	switch dest {
+	case "stdout":
+		return newWriterSink(console, r), nil
+	case "stderr":
+		return newWriterSink(os.Stderr, r), nil
+	}
+	f, err := openRotatingFile(dest, int64(rotateSize)*1024*1024, rotateAge, rotateKeep, rotateGzip)
+	if err != nil {
+		return nil, err
+	}
+	ws := newWriterSink(f, r)
+	ws.restart(f)
+	return ws, nil
+}
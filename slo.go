@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+type (
+	// sloMon tracks an availability objective (the fraction of responses that aren't 5xx) over a
+	// long period, alerting when the error budget burns too fast. Requests are rolled up into one
+	// bucket per minute, so memory doesn't grow with traffic.
+	sloMon struct {
+		objective float64       // objective is the target fraction of good responses, e.g. 0.999.
+		period    time.Duration // period is how long the objective covers, e.g. 30 days.
+		buckets   []sloBucket   // buckets are the per minute counts for the period, as a ring.
+		burns     []*burnRule   // burns are the burn rate alerts.
+		tex       *sync.Mutex   // tex is buckets' lock.
+	}
+
+	// sloBucket counts the requests in one minute.
+	sloBucket struct {
+		minute int64 // minute is the minute counted (unix minutes).
+		total  int64 // total is the number of requests.
+		errors int64 // errors is the number of 5xx responses.
+	}
+
+	// burnRule alerts when the burn rate over both a long and a short window reaches a factor. The
+	// long window makes it significant, the short one makes it recover quickly once fixed.
+	burnRule struct {
+		long  time.Duration // long is the long window.
+		short time.Duration // short is the short window.
+		alert *satMon       // alert holds the rule's name, factor, and alert state.
+	}
+
+	// sloStatus is the error budget as of a report.
+	sloStatus struct {
+		Objective float64            `json:"objective"`       // Objective is the target fraction of good responses.
+		Period    string             `json:"period"`          // Period is how long the objective covers.
+		Remaining float64            `json:"budgetRemaining"` // Remaining is the fraction of the error budget left (negative once spent).
+		Burns     map[string]float64 `json:"burnRates"`       // Burns are the burn rates per alert window.
+	}
+)
+
+// objective is the SLO rule, nil unless -slo is set.
+var objective *sloMon
+
+// newSLOMonitor returns a pointer to a new sloMon for the -slo objective over -slo-period, with
+// the multi-window multi-burn-rate alerts: 14.4x over 1h and 5m, and 6x over 6h and 30m.
+func newSLOMonitor(opts ...func(*sloMon)) *sloMon {
+	m := &sloMon{
+		objective: sloObjective,
+		period:    sloPeriod,
+		tex:       &sync.Mutex{},
+	}
+
+	for i := range opts {
+		opts[i](m)
+	}
+
+	m.buckets = make([]sloBucket, int(m.period/time.Minute))
+	m.burns = []*burnRule{
+		newBurnRule("SLO fast burn", time.Hour, 5*time.Minute, 14.4),
+		newBurnRule("SLO slow burn", 6*time.Hour, 30*time.Minute, 6),
+	}
+	return m
+}
+
+// newBurnRule returns a pointer to a new burnRule. Its alert's window is the long window, starting
+// now, so an alert restored firing doesn't recover before the long window has been observed.
+func newBurnRule(name string, long, short time.Duration, factor float64) *burnRule {
+	return &burnRule{
+		long:  long,
+		short: short,
+		alert: newSaturationMonitor(func(s *satMon) {
+			s.name = name
+			s.metric = "burnRate"
+			s.threshold = factor
+			s.recovery = 0
+			s.ttl = long
+			s.started = time.Now().UnixNano()
+		}),
+	}
+}
+
+// observe allows sloMon to implement the rule interface.
+func (m *sloMon) observe(e logEntry) {
+	m.add(time.Now(), e.respCode)
+}
+
+// add counts a response at now.
+func (m *sloMon) add(now time.Time, code int) {
+	minute := now.Unix() / 60
+	m.tex.Lock()
+	defer m.tex.Unlock()
+	b := &m.buckets[minute%int64(len(m.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if code >= 500 && code < 600 {
+		b.errors++
+	}
+}
+
+// seen allows sloMon to implement the rule interface.
+func (m *sloMon) seen() {}
+
+// restore allows sloMon to implement the rule interface.
+func (m *sloMon) restore(firing map[string]alertEvent) {
+	for i := range m.burns {
+		m.burns[i].alert.restore(firing)
+	}
+}
+
+// monitor allows sloMon to implement the rule interface.
+func (m *sloMon) monitor(ctx context.Context) {
+	for {
+		select {
+		default:
+			for _, e := range m.step(time.Now()) {
+				outputs.alert(e)
+			}
+
+			<-time.After(time.Second)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// step steps every burn rate alert, returning their transitions.
+func (m *sloMon) step(now time.Time) []alertEvent {
+	var out []alertEvent
+	for _, b := range m.burns {
+		// both windows reach the factor iff the lower of the two does
+		if e := b.alert.step(now, math.Min(m.burn(now, b.long), m.burn(now, b.short))); e != nil {
+			out = append(out, *e)
+		}
+	}
+	return out
+}
+
+// count returns the requests and errors in the window ending at now.
+func (m *sloMon) count(now time.Time, window time.Duration) (int64, int64) {
+	minute := now.Unix() / 60
+	minutes := int64(window / time.Minute)
+	if minutes > int64(len(m.buckets)) {
+		minutes = int64(len(m.buckets))
+	}
+	m.tex.Lock()
+	defer m.tex.Unlock()
+	var total, errors int64
+	for i := int64(0); i < minutes; i++ {
+		b := m.buckets[(minute-i)%int64(len(m.buckets))]
+		if b.minute == minute-i {
+			total += b.total
+			errors += b.errors
+		}
+	}
+	return total, errors
+}
+
+// burn returns how many times faster than sustainable the error budget burned over the window.
+func (m *sloMon) burn(now time.Time, window time.Duration) float64 {
+	total, errors := m.count(now, window)
+	if total == 0 {
+		return 0
+	}
+	return float64(errors) / float64(total) / (1 - m.objective)
+}
+
+// status returns the error budget as of now.
+func (m *sloMon) status(now time.Time) sloStatus {
+	s := sloStatus{
+		Objective: m.objective,
+		Period:    shortDuration(m.period),
+		Remaining: 1,
+		Burns:     map[string]float64{},
+	}
+	if total, errors := m.count(now, m.period); total > 0 {
+		s.Remaining = 1 - float64(errors)/float64(total)/(1-m.objective)
+	}
+	for _, b := range m.burns {
+		s.Burns[shortDuration(b.long)] = m.burn(now, b.long)
+		s.Burns[shortDuration(b.short)] = m.burn(now, b.short)
+	}
+	return s
+}
+
+// print prints the error budget to w.
+func (s sloStatus) print(w io.Writer) {
+	fmt.Fprintf(w, "Error budget:\n %.1f%% remaining of %s over %s\n\n", s.Remaining*100, formatPercent(s.Objective), s.Period)
+}
+
+// formatPercent returns a fraction as a percentage, with as many decimals as it needs.
+func formatPercent(f float64) string {
+	return fmt.Sprintf("%g%%", math.Round(f*1e6)/1e4)
+}
+
+// shortDuration returns d without zero units, e.g. "1h" rather than "1h0m0s".
+func shortDuration(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	if d%time.Minute == 0 {
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
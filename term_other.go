@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+// termSize returns the columns and rows of the terminal on stdout (80x24 if unknown).
+func termSize() (int, int) {
+	return 80, 24
+}
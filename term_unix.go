@@ -0,0 +1,21 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// termSize returns the columns and rows of the terminal on stdout (80x24 if unknown).
+func termSize() (int, int) {
+	var ws struct {
+		rows, cols, x, y uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(syscall.Stdout), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.cols == 0 || ws.rows == 0 {
+		return 80, 24
+	}
+	return int(ws.cols), int(ws.rows)
+}
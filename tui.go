@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// tui defines the full-screen terminal dashboard.
+type tui struct {
+	hits    int64         // hits is the number of requests seen since the last sample.
+	samples []int64       // samples is the requests per second for each second of the window, oldest first.
+	last    *stats        // last is the most recent interval report.
+	alerts  []string      // alerts is the alert history, oldest first.
+	tex     *sync.RWMutex // tex is samples', last's, and alerts' lock.
+}
+
+const (
+	// alertHistory is how many alert lines the terminal ui keeps.
+	alertHistory = 1000
+	// sparks are the characters used to draw the sparkline, smallest to largest.
+	sparks = "▁▂▃▄▅▆▇█"
+)
+
+// isTerminal returns true if f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newTui returns a pointer to a new tui whose sparkline covers window seconds.
+func newTui(window int) *tui {
+	return &tui{
+		samples: make([]int64, window),
+		tex:     &sync.RWMutex{},
+	}
+}
+
+// hit records a request for the sparkline.
+func (t *tui) hit() {
+	atomic.AddInt64(&t.hits, 1)
+}
+
+// run takes over the terminal, redrawing every second until ctx is done or bver is interrupted, when
+// it restores the terminal and calls cancel so bver shuts down cleanly.
+func (t *tui) run(ctx context.Context, cancel context.CancelFunc) {
+	defer cancel()
+
+	// alternate screen, hide cursor
+	os.Stdout.WriteString("\033[?1049h\033[?25l")
+	defer os.Stdout.WriteString("\033[?25h\033[?1049l")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			t.sample()
+			w, h := termSize()
+			os.Stdout.Write(t.render(w, h))
+		case <-sigs:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// report allows tui to implement the sink interface.
+func (t *tui) report(s stats) {
+	t.tex.Lock()
+	defer t.tex.Unlock()
+	t.last = &s
+}
+
+// alert allows tui to implement the sink interface.
+func (t *tui) alert(a alertEvent) {
+	line := sanitize(a.message())
+	t.tex.Lock()
+	defer t.tex.Unlock()
+	if len(t.alerts) >= alertHistory {
+		t.alerts = append(t.alerts[:0], t.alerts[1:]...)
+	}
+	t.alerts = append(t.alerts, line)
+}
+
+// sample moves the hits counted in the last second into the sparkline.
+func (t *tui) sample() {
+	t.tex.Lock()
+	defer t.tex.Unlock()
+	copy(t.samples, t.samples[1:])
+	t.samples[len(t.samples)-1] = atomic.SwapInt64(&t.hits, 0)
+}
+
+// render draws the whole screen for a terminal of w columns and h rows.
+func (t *tui) render(w, h int) []byte {
+	t.tex.RLock()
+	defer t.tex.RUnlock()
+
+	var lines []string
+	title := fmt.Sprintf(" bver - %s ", logSource)
+	lines = append(lines, "\033[7m"+truncate(title+strings.Repeat(" ", w), w)+"\033[0m")
+
+	// sparkline
+	line, peak := sparkline(t.samples, w-2)
+	lines = append(lines, fmt.Sprintf("Requests/sec over %ds (peak %d)", len(t.samples), peak), " "+line, "")
+
+	// unique visitors
+	if t.last != nil && t.last.windowVisitors != nil {
+		v, wv := t.last.visitorCounts()[""], t.last.windowVisitors
+		lines = append(lines, truncate(fmt.Sprintf("Unique visitors %d ±%d, last %ds %d ±%d", v.Estimate, v.Error, t.last.windowSeconds, wv.Estimate, wv.Error), w), "")
+	}
+
+	// top clients
+	if t.last != nil && len(t.last.topClients) > 0 {
+		lines = append(lines, truncate(sanitize("Top clients "+formatClients(t.last.topClients, "hits")), w), "")
+	}
+
+	// top countries
+	if t.last != nil && len(t.last.topCountries) > 0 {
+		parts := make([]string, len(t.last.topCountries))
+		for i, c := range t.last.topCountries {
+			parts[i] = fmt.Sprintf("%s (%d)", c.Key, c.Count)
+		}
+		lines = append(lines, truncate(sanitize("Top countries "+strings.Join(parts, ", ")), w), "")
+	}
+
+	// leave at least 5 rows for alerts
+	rows := (h - len(lines) - 9) / 2
+	if rows < 1 {
+		rows = 1
+	}
+
+	// sections
+	lines = append(lines, "Top sections")
+	var reqs reqSlice
+	var ress resSlice
+	if t.last != nil {
+		reqs, ress = t.last.requests, t.last.responses
+	}
+	for i := 0; i < rows; i++ {
+		if i < len(reqs) {
+			lines = append(lines, truncate(fmt.Sprintf("%6d %s", reqs[i].count, sanitize(reqs[i].section)), w))
+		} else {
+			lines = append(lines, "")
+		}
+	}
+	lines = append(lines, "")
+
+	// status codes
+	lines = append(lines, "Status codes")
+	barWidth := w - 12
+	if barWidth < 0 {
+		barWidth = 0
+	}
+	max := 1
+	for i := range ress {
+		if ress[i].count > max {
+			max = ress[i].count
+		}
+	}
+	for i := 0; i < rows; i++ {
+		if i < len(ress) {
+			bar := strings.Repeat("█", ress[i].count*barWidth/max)
+			lines = append(lines, fmt.Sprintf("%s %6d %s", colorCode(ress[i].code), ress[i].count, bar))
+		} else {
+			lines = append(lines, "")
+		}
+	}
+	lines = append(lines, "")
+
+	// alerts, newest first
+	lines = append(lines, fmt.Sprintf("Alerts (%d)", len(t.alerts)))
+	for i := len(t.alerts) - 1; i >= 0 && len(lines) < h; i-- {
+		lines = append(lines, truncate(t.alerts[i], w))
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("\033[H")
+	for i := 0; i < h; i++ {
+		if i < len(lines) {
+			buf.WriteString(lines[i])
+		}
+		buf.WriteString("\033[K")
+		if i < h-1 {
+			buf.WriteString("\r\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// sparkline draws samples in at most width characters, averaging samples if there are more than
+// fit. It also returns the peak sample.
+func sparkline(samples []int64, width int) (string, int64) {
+	if width < 1 || len(samples) == 0 {
+		return "", 0
+	}
+	per := (len(samples) + width - 1) / width
+	var buckets []int64
+	var peak int64
+	for i := 0; i < len(samples); i += per {
+		var sum int64
+		n := 0
+		for j := i; j < i+per && j < len(samples); j++ {
+			sum += samples[j]
+			n++
+			if samples[j] > peak {
+				peak = samples[j]
+			}
+		}
+		buckets = append(buckets, sum/int64(n))
+	}
+
+	chars := []rune(sparks)
+	var top int64 = 1
+	for i := range buckets {
+		if buckets[i] > top {
+			top = buckets[i]
+		}
+	}
+	out := make([]rune, len(buckets))
+	for i := range buckets {
+		out[i] = chars[int(buckets[i]*int64(len(chars)-1)/top)]
+	}
+	return string(out), peak
+}
+
+// colorCode returns a status code colored by its class.
+func colorCode(code int) string {
+	color := "37"
+	switch code / 100 {
+	case 2:
+		color = "32"
+	case 3:
+		color = "36"
+	case 4:
+		color = "33"
+	case 5:
+		color = "31"
+	}
+	return fmt.Sprintf("\033[%sm%d\033[0m", color, code)
+}
+
+// sanitize replaces the control characters in s, which could move the cursor or restyle the screen,
+// with '?'.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// truncate truncates s to w runes.
+func truncate(s string, w int) string {
+	r := []rune(s)
+	if w >= 0 && len(r) > w {
+		return string(r[:w])
+	}
+	return s
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type (
+	// uaRule classifies user agents matching a pattern.
+	uaRule struct {
+		family  string         // family is the kind of client: browser, mobile, crawler, bot, or library.
+		name    string         // name is the client, e.g. "Chrome" or "Googlebot".
+		pattern *regexp.Regexp // pattern matches the user agents the rule classifies.
+	}
+
+	// uaClass is a user agent's classification.
+	uaClass struct {
+		family string // family is the kind of client, or "unknown".
+		name   string // name is the client, or "empty" or "other" if unknown.
+	}
+
+	// uaClassifier classifies user agents by the first matching rule, caching recent answers.
+	uaClassifier struct {
+		rules []uaRule           // rules are tried in order.
+		cache map[string]uaClass // cache is recent classifications, by user agent.
+		tex   *sync.Mutex        // tex is rules' and cache's lock.
+	}
+)
+
+const (
+	// uaCacheSize is how many user agents a uaClassifier caches before starting over.
+	uaCacheSize = 4096
+	// agentTop is how many of the busiest user agent classifications reports show.
+	agentTop = 10
+)
+
+// uaFamilies are the families a rule may classify into.
+var uaFamilies = map[string]bool{"browser": true, "mobile": true, "crawler": true, "bot": true, "library": true}
+
+// defaultUARules are the built in user agent rules, in the -ua-rules file format. Crawlers and bots
+// come first, since many claim to be browsers too, and mobile browsers before desktop ones.
+const defaultUARules = `# family   name              pattern (case insensitive regexp, first match wins)
+crawler    Googlebot         googlebot|google-inspectiontool|adsbot-google|mediapartners-google
+crawler    Bingbot           bingbot|bingpreview|msnbot
+crawler    Yandex            yandex(bot|images|mobilebot)
+crawler    Baiduspider       baiduspider
+crawler    DuckDuckBot       duckduckbot
+crawler    Applebot          applebot
+crawler    Yahoo             yahoo! slurp
+crawler    Sogou             sogou
+crawler    Seznam            seznambot
+crawler    Naver             yeti/
+bot        AhrefsBot         ahrefsbot
+bot        SemrushBot        semrushbot
+bot        MJ12bot           mj12bot
+bot        DotBot            dotbot
+bot        PetalBot          petalbot
+bot        GPTBot            gptbot
+bot        facebook          facebookexternalhit|facebot
+bot        Twitterbot        twitterbot
+bot        Slackbot          slackbot
+bot        UptimeRobot       uptimerobot
+bot        Pingdom           pingdom
+bot        other             bot\b|crawl|spider|slurp|scan|monitor|feedfetcher|preview
+library    curl              ^curl/
+library    Wget              ^wget/
+library    python-requests   python-requests
+library    python            python-urllib|aiohttp|httpx|scrapy
+library    Go                go-http-client
+library    Java              ^java/|apache-httpclient|okhttp
+library    Node              node-fetch|axios|undici
+library    Ruby              ^ruby|faraday
+library    PHP               guzzlehttp|^php
+library    libwww-perl       libwww-perl
+library    PowerShell        windowspowershell
+library    HTTPie            httpie
+library    Postman           postmanruntime
+mobile     Safari            (iphone|ipad|ipod).*version/.*mobile.*safari
+mobile     Chrome            android.*chrome/.*mobile|crios/
+mobile     Firefox           android.*firefox/|fxios/
+mobile     Samsung           samsungbrowser
+mobile     other             mobile|android|iphone|ipad
+browser    Edge              edg(e|a|ios)?/
+browser    Opera             opr/|opera
+browser    Firefox           firefox/
+browser    Chrome            chrome/|chromium/
+browser    Safari            version/.*safari/
+browser    IE                msie |trident/
+`
+
+// agents classifies user agents with -ua-rules, or the default rules.
+var agents = mustUAClassifier(defaultUARules)
+
+// parseUARules parses user agent rules, one per line as "family name pattern". Blank lines and lines
+// starting with # are skipped.
+func parseUARules(s string) ([]uaRule, error) {
+	var rules []uaRule
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < 3 {
+			return nil, fmt.Errorf("Line %d - expected family, name, and pattern", n)
+		}
+		if !uaFamilies[f[0]] {
+			return nil, fmt.Errorf("Line %d - unknown family %q", n, f[0])
+		}
+		// the pattern is the rest of the line, and may have spaces
+		rest := strings.TrimSpace(line[len(f[0]):])
+		pattern := strings.TrimSpace(rest[len(f[1]):])
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d - %s", n, err.Error())
+		}
+		rules = append(rules, uaRule{family: f[0], name: f[1], pattern: re})
+	}
+	return rules, sc.Err()
+}
+
+// mustUAClassifier returns a pointer to a new uaClassifier using rules, panicking if they're bad.
+func mustUAClassifier(rules string) *uaClassifier {
+	rs, err := parseUARules(rules)
+	if err != nil {
+		panic(err)
+	}
+	return &uaClassifier{rules: rs, cache: map[string]uaClass{}, tex: &sync.Mutex{}}
+}
+
+// load replaces the rules with those in the file at path.
+func (uc *uaClassifier) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rs, err := parseUARules(string(b))
+	if err != nil {
+		return err
+	}
+	uc.tex.Lock()
+	defer uc.tex.Unlock()
+	uc.rules, uc.cache = rs, map[string]uaClass{}
+	return nil
+}
+
+// classify returns a user agent's classification. Empty agents are "unknown empty", and those no
+// rule matches are "unknown other".
+func (uc *uaClassifier) classify(ua string) uaClass {
+	if ua == "" || ua == "-" {
+		return uaClass{family: "unknown", name: "empty"}
+	}
+	uc.tex.Lock()
+	defer uc.tex.Unlock()
+	if c, ok := uc.cache[ua]; ok {
+		return c
+	}
+	c := uaClass{family: "unknown", name: "other"}
+	for _, r := range uc.rules {
+		if r.pattern.MatchString(ua) {
+			c = uaClass{family: r.family, name: r.name}
+			break
+		}
+	}
+	if len(uc.cache) >= uaCacheSize {
+		uc.cache = map[string]uaClass{}
+	}
+	uc.cache[ua] = c
+	return c
+}
+
+// String allows uaClass to implement the fmt.Stringer interface.
+func (c uaClass) String() string {
+	return c.family + " " + c.name
+}
+
+// bot returns true if the entry's user agent is a crawler, bot, or http library.
+func (e logEntry) bot() bool {
+	return e.agent.family == "crawler" || e.agent.family == "bot" || e.agent.family == "library"
+}
+
+// addAgent counts an entry toward its user agent's classification for the interval.
+func (s *stats) addAgent(e logEntry) {
+	s.reqTex.Lock()
+	defer s.reqTex.Unlock()
+	if s.agents == nil {
+		s.agents = map[string]int{}
+	}
+	s.agents[e.agentName()]++
+}
+
+// printAgents prints the busiest user agent classifications to w.
+func (s stats) printAgents(w io.Writer) {
+	if len(s.topAgents) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "User agents:")
+	for _, c := range s.topAgents {
+		fmt.Fprintf(w, "%3d %s\n", c.Count, c.Key)
+	}
+	fmt.Fprintln(w)
+}
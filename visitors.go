@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sort"
+)
+
+type (
+	// hll is a HyperLogLog sketch estimating how many distinct strings were added, in fixed memory.
+	// It starts sparse, holding only the registers that are set, and becomes dense once enough are,
+	// so the many sketches of little visited sections stay small.
+	hll struct {
+		registers []uint8  // registers hold the longest run of leading zeros seen per bucket, plus 1. (nil while sparse)
+		sparse    []uint32 // sparse are the set registers as index<<8 | value, while few are set.
+	}
+
+	// visitorCount is an estimated count of unique visitors.
+	visitorCount struct {
+		Estimate int64 `json:"estimate"` // Estimate is the estimated number of unique visitors.
+		Error    int64 `json:"error"`    // Error is the estimate's standard error, as a count.
+	}
+
+	// visitorWindow estimates unique visitors over a sliding window of report intervals.
+	visitorWindow struct {
+		slots   []*hll // slots are the sketches for each interval of the window, as a ring.
+		cur     int    // cur is the slot for the current interval.
+		seconds int    // seconds is how long the window is.
+	}
+)
+
+// hllPrecision is how many hash bits pick a register. 2^12 registers (4KB) give a standard error of
+// about 1.6%.
+const hllPrecision = 12
+
+// hllSparseMax is how many registers a sparse hll sets before becoming dense (1KB, a quarter of the
+// dense size).
+const hllSparseMax = 256
+
+// newHLL returns a pointer to a new, empty (sparse) hll.
+func newHLL() *hll {
+	return &hll{}
+}
+
+// set raises register i to rank, if it's lower.
+func (h *hll) set(i uint32, rank uint8) {
+	if h.registers != nil {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+		return
+	}
+	for j, e := range h.sparse {
+		if e>>8 == i {
+			if rank > uint8(e) {
+				h.sparse[j] = i<<8 | uint32(rank)
+			}
+			return
+		}
+	}
+	if len(h.sparse) < hllSparseMax {
+		h.sparse = append(h.sparse, i<<8|uint32(rank))
+		return
+	}
+	h.registers = make([]uint8, 1<<hllPrecision)
+	for _, e := range h.sparse {
+		h.registers[e>>8] = uint8(e)
+	}
+	h.sparse = nil
+	h.registers[i] = rank
+}
+
+// clone returns a pointer to a copy of the sketch.
+func (h *hll) clone() *hll {
+	c := &hll{}
+	if h.registers != nil {
+		c.registers = append([]uint8{}, h.registers...)
+	} else {
+		c.sparse = append([]uint32{}, h.sparse...)
+	}
+	return c
+}
+
+// add adds s to the sketch.
+func (h *hll) add(s string) {
+	f := fnv.New64a()
+	io.WriteString(f, s)
+	x := mix64(f.Sum64())
+	i := x >> (64 - hllPrecision)
+	// count leading zeros of the remaining bits, with a sentinel bit so it's bounded
+	rest := x<<hllPrecision | 1<<(hllPrecision-1)
+	rank := uint8(1)
+	for rest&(1<<63) == 0 {
+		rank++
+		rest <<= 1
+	}
+	h.set(uint32(i), rank)
+}
+
+// mix64 scrambles a hash's bits (the splitmix64 finalizer), since fnv's top bits are uneven.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// merge adds all of o's strings to the sketch.
+func (h *hll) merge(o *hll) {
+	for i, r := range o.registers {
+		if r > 0 {
+			h.set(uint32(i), r)
+		}
+	}
+	for _, e := range o.sparse {
+		h.set(e>>8, uint8(e))
+	}
+}
+
+// count returns the sketch's estimate of distinct strings added, and its standard error.
+func (h *hll) count() visitorCount {
+	m := float64(1 << hllPrecision)
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	if h.registers == nil {
+		zeros = 1<<hllPrecision - len(h.sparse)
+		sum = float64(zeros)
+		for _, e := range h.sparse {
+			sum += math.Pow(2, -float64(uint8(e)))
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// small cardinalities are more accurate by linear counting
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return visitorCount{
+		Estimate: int64(math.Round(estimate)),
+		Error:    int64(math.Ceil(estimate * 1.04 / math.Sqrt(m))),
+	}
+}
+
+// newVisitorWindow returns a pointer to a new visitorWindow covering seconds, in intervals of freq
+// seconds.
+func newVisitorWindow(seconds, freq int) *visitorWindow {
+	slots := make([]*hll, (seconds+freq-1)/freq)
+	for i := range slots {
+		slots[i] = newHLL()
+	}
+	return &visitorWindow{slots: slots, seconds: len(slots) * freq}
+}
+
+// add adds a visitor to the current interval.
+func (vw *visitorWindow) add(visitor string) {
+	vw.slots[vw.cur].add(visitor)
+}
+
+// count returns the estimated unique visitors over the window.
+func (vw *visitorWindow) count() visitorCount {
+	window := newHLL()
+	for i := range vw.slots {
+		window.merge(vw.slots[i])
+	}
+	return window.count()
+}
+
+// advance moves to the next interval's slot, dropping the oldest interval.
+func (vw *visitorWindow) advance() {
+	vw.cur = (vw.cur + 1) % len(vw.slots)
+	vw.slots[vw.cur] = newHLL()
+}
+
+// addVisitor counts an entry's remote host (without any port, see clientHost) toward the
+// interval's and its section's unique visitors.
+func (s *stats) addVisitor(e logEntry) {
+	s.reqTex.Lock()
+	defer s.reqTex.Unlock()
+	if s.visitors == nil {
+		s.visitors = map[string]*hll{}
+	}
+	host := clientHost(e.remoteHost)
+	for _, key := range []string{"", sectionOf(e.request.path)} {
+		if s.visitors[key] == nil {
+			s.visitors[key] = newHLL()
+		}
+		s.visitors[key].add(host)
+	}
+}
+
+// visitorCounts returns the estimated unique visitors overall ("") and per section.
+func (s stats) visitorCounts() map[string]visitorCount {
+	out := map[string]visitorCount{}
+	for key, h := range s.visitors {
+		out[key] = h.count()
+	}
+	return out
+}
+
+// printVisitors prints the estimated unique visitors to w, for the interval, the window, and each
+// section.
+func (s stats) printVisitors(w io.Writer) {
+	if len(s.visitors) == 0 {
+		return
+	}
+	counts := s.visitorCounts()
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(w, "Unique visitors:")
+	for _, key := range keys {
+		name := key
+		if name == "" {
+			name = "all"
+		}
+		fmt.Fprintf(w, " %d ±%d %s\n", counts[key].Estimate, counts[key].Error, name)
+	}
+	if s.windowVisitors != nil {
+		fmt.Fprintf(w, " %d ±%d last %ds\n", s.windowVisitors.Estimate, s.windowVisitors.Error, s.windowSeconds)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type (
+	// webhookSink POSTs alert transitions to a url. Interval reports aren't sent.
+	webhookSink struct {
+		url       string               // url is where alerts are posted.
+		body      *template.Template   // body renders the request body from a webhookPayload.
+		client    *http.Client         // client sends the requests, with the timeout.
+		retries   int                  // retries is how many times a failed post is retried.
+		backoff   time.Duration        // backoff is the wait before the first retry, doubled after each.
+		triggered map[string]time.Time // triggered is when each firing rule (and client, for security alerts) triggered.
+		tex       *sync.Mutex          // tex is triggered's lock.
+	}
+
+	// webhookPayload is what webhook body templates are rendered with. The default body is it as json.
+	webhookPayload struct {
+		Rule        string     `json:"rule"`                  // Rule is the name of the rule that transitioned.
+		Metric      string     `json:"metric"`                // Metric is what the rule measures.
+		Section     string     `json:"section,omitempty"`     // Section is the section the rule is limited to, if any.
+		RemoteHost  string     `json:"remoteHost,omitempty"`  // RemoteHost is the offending client, for security alerts.
+		Path        string     `json:"path,omitempty"`        // Path is the client's last suspicious request, for security alerts.
+		Status      string     `json:"status"`                // Status is "triggered" or "recovered".
+		Value       float64    `json:"value"`                 // Value is the measurement at the time of the transition.
+		Op          string     `json:"op"`                    // Op is how the value was compared to the threshold.
+		Threshold   float64    `json:"threshold"`             // Threshold is the limit the value was compared against.
+		TriggeredAt *time.Time `json:"triggeredAt,omitempty"` // TriggeredAt is when the alert fired, if known.
+		RecoveredAt *time.Time `json:"recoveredAt,omitempty"` // RecoveredAt is when the alert recovered, if it did.
+		Message     string     `json:"message"`               // Message is the console message for the transition.
+	}
+)
+
+// webhookTemplates are the built in webhook bodies.
+var webhookTemplates = map[string]string{
+	"json":  `{{json .}}`,
+	"slack": `{"text":{{json .Message}}}`,
+}
+
+// newWebhookSink builds a webhookSink from a "[template=]url" spec. Template is json (the
+// default), slack, or the path of a text/template file, which can use the json function to quote.
+func newWebhookSink(spec string) (*webhookSink, error) {
+	name, url := "json", spec
+	if i := strings.Index(spec, "="); i > 0 && !strings.Contains(spec[:i], "://") {
+		name, url = spec[:i], spec[i+1:]
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("Url must be http or https")
+	}
+
+	text, ok := webhookTemplates[name]
+	if !ok {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	body, err := template.New(name).Funcs(template.FuncMap{"json": toJSON}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhookSink{
+		url:       url,
+		body:      body,
+		client:    &http.Client{Timeout: webhookTimeout},
+		retries:   webhookRetries,
+		backoff:   time.Second,
+		triggered: map[string]time.Time{},
+		tex:       &sync.Mutex{},
+	}, nil
+}
+
+// toJSON returns v encoded as json, for templates.
+func toJSON(v interface{}) (string, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n"), err
+}
+
+// report allows webhookSink to implement the sink interface.
+func (ws *webhookSink) report(s stats) {}
+
+// alert allows webhookSink to implement the sink interface. Failed posts are retried with backoff,
+// then logged and given up on.
+func (ws *webhookSink) alert(a alertEvent) {
+	buf := &bytes.Buffer{}
+	if err := ws.body.Execute(buf, ws.payload(a)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to render webhook body - %s\n", err.Error())
+		return
+	}
+
+	wait := ws.backoff
+	for try := 0; ; try++ {
+		retry, err := ws.post(buf.Bytes())
+		if err == nil {
+			return
+		}
+		if !retry || try >= ws.retries {
+			fmt.Fprintf(os.Stderr, "Failed to post alert to %s - %s\n", ws.url, err.Error())
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// payload returns the template data for an alert, remembering when firing rules triggered.
+func (ws *webhookSink) payload(a alertEvent) webhookPayload {
+	p := webhookPayload{
+		Rule:       a.Rule,
+		Metric:     a.Metric,
+		Section:    a.Section,
+		RemoteHost: a.RemoteHost,
+		Path:       a.Path,
+		Status:     "recovered",
+		Value:      a.Value,
+		Op:         a.Op,
+		Threshold:  a.Threshold,
+		Message:    a.message(),
+	}
+
+	ws.tex.Lock()
+	defer ws.tex.Unlock()
+	t := a.Time
+	if a.Triggered {
+		p.Status = "triggered"
+		ws.triggered[a.subject()] = t
+		p.TriggeredAt = &t
+		return p
+	}
+	if at, ok := ws.triggered[a.subject()]; ok {
+		p.TriggeredAt = &at
+		delete(ws.triggered, a.subject())
+	}
+	p.RecoveredAt = &t
+	return p
+}
+
+// post sends one request. It returns whether a failure is worth retrying: connection errors, 429s,
+// and 5xxs are, other statuses aren't.
+func (ws *webhookSink) post(body []byte) (bool, error) {
+	resp, err := ws.client.Post(ws.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, fmt.Errorf("Received %s", resp.Status)
+}